@@ -0,0 +1,345 @@
+package bins
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/sirupsen/logrus"
+)
+
+// The bins artifact replaces the old marco.csv. Layout (integers little-endian):
+//
+//	"BM25BINS" | uint32 version | uint32 header length | JSON ArtifactHeader
+//	doc dictionary: NumDocs x (uvarint length | _id bytes)
+//	bins: NumBins x (uvarint count | count x uvarint delta of the sorted doc indices)
+//	terms per bin: NumBins x uvarint
+//	uint32 CRC-32 (IEEE) of everything after the magic
+//
+// Bins hold indices into the doc dictionary rather than the _id strings themselves.
+
+const (
+	artifactMagic   = "BM25BINS"
+	ArtifactVersion = 2 // 2 added the BuildStats
+
+	// AnalyzerID names strictEnglishAnalyzer, change it whenever the analyzer changes
+	AnalyzerID = "strict-english-v1"
+	// HashID names hashTokenChoice, first 8 bytes (big-endian) of SHA-256(term | big-endian uint32 choice)
+	HashID = "sha256-term-be32choice-v1"
+	// HashKey is the key hashTokenChoice is keyed with, it's currently unkeyed
+	HashKey = uint64(0)
+)
+
+// ArtifactHeader describes how a bins artifact was built, so the loader can refuse to pair it with the wrong corpus
+type ArtifactHeader struct {
+	Config         Config
+	Analyzer       string
+	Hash           string
+	HashKey        uint64
+	Dataset        string
+	CorpusChecksum string // CorpusChecksum of the corpus the bins were built from
+	NumDocs        int
+	NumBins        int
+	Searched       uint64 // BuildStats.Searched
+	Dropped        uint64 // BuildStats.Dropped
+
+	// Quantizer the PIR entries are encoded with, fitted when the bins are built for an encoding that needs it (see
+	// VectorEncoding.Fitted). It's optional, so artifacts from before quantization still load.
+	Quantizer *Quantizer `json:",omitempty"`
+
+	// CentroidsChecksum of the centroids BinKMeans bins were built from, the client needs the same ones to probe them
+	Centroids string `json:",omitempty"`
+}
+
+// BinsArtifact is a bin table along with the doc-ID dictionary its indices point into
+type BinsArtifact struct {
+	Header      ArtifactHeader
+	DocIDs      []string   // doc index -> corpus _id
+	Bins        [][]uint32 // sorted doc indices in each bin
+	TermsPerBin []uint32   // BuildStats.TermsPerBin
+}
+
+// ScanCorpusIDs streams a BEIR corpus and returns its _ids in file order along with its CorpusChecksum
+func ScanCorpusIDs(path string) ([]string, string, error) {
+	var ids []string
+	h := sha256.New()
+	err := streamCorpusWithHash(path, h, logrus.ErrorLevel, func(doc beirDoc) error {
+		ids = append(ids, doc.ID)
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return ids, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// CorpusChecksum is the hex SHA-256 of the corpus file
+func CorpusChecksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// NewBinsArtifact converts a bin table of _ids into an artifact over the doc dictionary docIDs (normally the corpus
+// order from ScanCorpusIDs). Every _id in the table has to be in the dictionary.
+func NewBinsArtifact(DB [][]string, stats BuildStats, docIDs []string, dataset string, corpusChecksum string, config Config) (*BinsArtifact, error) {
+	if len(stats.TermsPerBin) != len(DB) {
+		return nil, fmt.Errorf("NewBinsArtifact: stats for %d bins, but there are %d bins", len(stats.TermsPerBin), len(DB))
+	}
+
+	index := make(map[string]uint32, len(docIDs))
+	for i, id := range docIDs {
+		if _, ok := index[id]; ok {
+			return nil, fmt.Errorf("NewBinsArtifact: duplicate doc ID %q in the dictionary", id)
+		}
+		index[id] = uint32(i)
+	}
+
+	art := &BinsArtifact{
+		Header: ArtifactHeader{
+			Config:         config,
+			Analyzer:       AnalyzerID,
+			Hash:           HashID,
+			HashKey:        HashKey,
+			Dataset:        dataset,
+			CorpusChecksum: corpusChecksum,
+			NumDocs:        len(docIDs),
+			NumBins:        len(DB),
+			Searched:       stats.Searched,
+			Dropped:        stats.Dropped,
+		},
+		DocIDs:      docIDs,
+		Bins:        make([][]uint32, len(DB)),
+		TermsPerBin: stats.TermsPerBin,
+	}
+
+	for b, bin := range DB {
+		rows := make([]uint32, len(bin))
+		for j, id := range bin {
+			i, ok := index[id]
+			if !ok {
+				return nil, fmt.Errorf("NewBinsArtifact: bin %d holds %q, which isn't in the doc dictionary", b, id)
+			}
+			rows[j] = i
+		}
+		sort.Slice(rows, func(x, y int) bool { return rows[x] < rows[y] })
+		art.Bins[b] = rows
+	}
+
+	return art, nil
+}
+
+// Check compares the artifact against the dataset, Config and corpus a caller is about to use it with. An empty
+// corpusChecksum skips the corpus check.
+func (a *BinsArtifact) Check(dataset string, config Config, corpusChecksum string) error {
+	if a.Header.Dataset != dataset {
+		return fmt.Errorf("bins artifact was built for dataset %q, not %q", a.Header.Dataset, dataset)
+	}
+	if !a.Header.Config.sameBins(config) {
+		return fmt.Errorf("bins artifact was built with %+v, not %+v", a.Header.Config, config)
+	}
+	if corpusChecksum != "" && a.Header.CorpusChecksum != corpusChecksum {
+		return fmt.Errorf("bins artifact was built from a corpus with checksum %s, not %s",
+			a.Header.CorpusChecksum, corpusChecksum)
+	}
+	return nil
+}
+
+// WriteBinsArtifact writes a to path through a temp file, so a crash or a full disk never leaves a truncated artifact
+// behind (or destroys the one that was there)
+func WriteBinsArtifact(path string, a *BinsArtifact) error {
+	header, err := json.Marshal(a.Header)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, func(f *os.File) error {
+		return writeBinsArtifact(f, a, header)
+	})
+}
+
+func writeBinsArtifact(f *os.File, a *BinsArtifact, header []byte) error {
+	bw := bufio.NewWriterSize(f, 1<<20)
+	if _, err := bw.WriteString(artifactMagic); err != nil {
+		return err
+	}
+
+	crc := crc32.NewIEEE()
+	w := io.MultiWriter(bw, crc)
+
+	var buf []byte
+	buf = binary.LittleEndian.AppendUint32(buf, ArtifactVersion)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(header)))
+	buf = append(buf, header...)
+	if _, err := w.Write(buf); err != nil {
+		return err
+	}
+
+	for _, id := range a.DocIDs {
+		buf = binary.AppendUvarint(buf[:0], uint64(len(id)))
+		buf = append(buf, id...)
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+	}
+
+	for _, bin := range a.Bins {
+		buf = binary.AppendUvarint(buf[:0], uint64(len(bin)))
+		prev := uint32(0)
+		for _, row := range bin {
+			buf = binary.AppendUvarint(buf, uint64(row-prev))
+			prev = row
+		}
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+	}
+
+	buf = buf[:0]
+	for _, n := range a.TermsPerBin {
+		buf = binary.AppendUvarint(buf, uint64(n))
+	}
+	if _, err := w.Write(buf); err != nil {
+		return err
+	}
+
+	if err := binary.Write(bw, binary.LittleEndian, crc.Sum32()); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// ReadBinsArtifact loads and validates a bins artifact: the checksum, the format version, that it was built with this
+// analyzer and hash function, and that every bin is a sorted set of valid doc indices. Use Check to compare it with a
+// Config and corpus.
+func ReadBinsArtifact(path string) (*BinsArtifact, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	fail := func(format string, args ...any) (*BinsArtifact, error) {
+		return nil, fmt.Errorf("bins artifact %s: %s", path, fmt.Sprintf(format, args...))
+	}
+
+	if len(data) < len(artifactMagic)+12 || string(data[:len(artifactMagic)]) != artifactMagic {
+		return fail("not a bins artifact")
+	}
+	body := data[len(artifactMagic) : len(data)-4]
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(data[len(data)-4:]) {
+		return fail("checksum mismatch, the file is corrupt or truncated")
+	}
+
+	version := binary.LittleEndian.Uint32(body)
+	if version != ArtifactVersion {
+		return fail("format version %d, this build reads version %d", version, ArtifactVersion)
+	}
+	headerLen := int(binary.LittleEndian.Uint32(body[4:]))
+	if 8+headerLen > len(body) {
+		return fail("header runs past the end of the file")
+	}
+
+	a := &BinsArtifact{}
+	if err := json.Unmarshal(body[8:8+headerLen], &a.Header); err != nil {
+		return fail("header: %v", err)
+	}
+	h := a.Header
+	if h.Analyzer != AnalyzerID {
+		return fail("built with analyzer %q, this build uses %q", h.Analyzer, AnalyzerID)
+	}
+	if h.Hash != HashID || h.HashKey != HashKey {
+		return fail("built with hash %q (key %d), this build uses %q (key %d)", h.Hash, h.HashKey, HashID, HashKey)
+	}
+	if h.Quantizer != nil {
+		if err := h.Quantizer.Check(); err != nil {
+			return fail("%v", err)
+		}
+	}
+	if h.NumBins != int(h.Config.MaxBins) {
+		return fail("%d bins but Config.MaxBins is %d", h.NumBins, h.Config.MaxBins)
+	}
+
+	r := bytes.NewReader(body[8+headerLen:])
+
+	a.DocIDs = make([]string, h.NumDocs)
+	for i := range a.DocIDs {
+		n, err := binary.ReadUvarint(r)
+		if err != nil || n > uint64(r.Len()) {
+			return fail("doc dictionary truncated at doc %d", i)
+		}
+		id := make([]byte, n)
+		r.Read(id)
+		a.DocIDs[i] = string(id)
+	}
+
+	a.Bins = make([][]uint32, h.NumBins)
+	for b := range a.Bins {
+		n, err := binary.ReadUvarint(r)
+		if err != nil || n > uint64(h.NumDocs) {
+			return fail("bin %d has a bad length", b)
+		}
+		bin := make([]uint32, n)
+		row := uint64(0)
+		for j := range bin {
+			delta, err := binary.ReadUvarint(r)
+			if err != nil {
+				return fail("bin %d truncated", b)
+			}
+			if j > 0 && delta == 0 {
+				return fail("bin %d holds doc %d twice", b, row)
+			}
+			row += delta
+			if row >= uint64(h.NumDocs) {
+				return fail("bin %d holds doc index %d, but there are only %d docs", b, row, h.NumDocs)
+			}
+			bin[j] = uint32(row)
+		}
+		a.Bins[b] = bin
+	}
+	a.TermsPerBin = make([]uint32, h.NumBins)
+	for b := range a.TermsPerBin {
+		n, err := binary.ReadUvarint(r)
+		if err != nil || n > uint64(^uint32(0)) {
+			return fail("terms per bin truncated at bin %d", b)
+		}
+		a.TermsPerBin[b] = uint32(n)
+	}
+
+	if r.Len() != 0 {
+		return fail("%d unexpected bytes after the bins", r.Len())
+	}
+
+	return a, nil
+}
+
+// Stats returns the BuildStats recorded in the artifact
+func (a *BinsArtifact) Stats() BuildStats {
+	return BuildStats{Searched: a.Header.Searched, Dropped: a.Header.Dropped, TermsPerBin: a.TermsPerBin}
+}
+
+// NonEmpty counts the bins holding at least one document
+func (a *BinsArtifact) NonEmpty() int {
+	n := 0
+	for _, bin := range a.Bins {
+		if len(bin) > 0 {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,356 @@
+package bins
+
+import (
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/dkblackley/bm25-bins-go/pianopir"
+)
+
+func TestBinsArtifactRoundTrip(t *testing.T) {
+	config := Config{K: 4, D: 1, MaxBins: 4, Threshold: 1}
+	docIDs := []string{"10", "3jolt83r", "7", "1hvihwkz"}
+	DB := [][]string{{"7", "10"}, {}, {"1hvihwkz", "3jolt83r", "10"}, {"7"}}
+
+	stats := BuildStats{Searched: 5, Dropped: 2, TermsPerBin: []uint32{2, 0, 3, 1}}
+
+	art, err := NewBinsArtifact(DB, stats, docIDs, "test", "abc123", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := [][]uint32{{0, 2}, {}, {0, 1, 3}, {2}}; !reflect.DeepEqual(art.Bins, want) {
+		t.Errorf("Bins = %v; want %v", art.Bins, want)
+	}
+
+	path := filepath.Join(t.TempDir(), "test.bins")
+	if err := WriteBinsArtifact(path, art); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadBinsArtifact(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, art) {
+		t.Errorf("ReadBinsArtifact = %+v; want %+v", got, art)
+	}
+
+	if err := got.Check("test", config, "abc123"); err != nil {
+		t.Errorf("Check with the build config and corpus: %v", err)
+	}
+	if err := got.Check("test", config, "def456"); err == nil {
+		t.Errorf("Check accepted a different corpus")
+	}
+	if err := got.Check("scifact", config, ""); err == nil {
+		t.Errorf("Check accepted a different dataset")
+	}
+	config.MaxBins = 5
+	if err := got.Check("test", config, ""); err == nil {
+		t.Errorf("Check accepted a different Config")
+	}
+
+	// Flip a bit in the middle of the bins
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-8] ^= 1
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadBinsArtifact(path); err == nil {
+		t.Errorf("ReadBinsArtifact accepted a corrupted file")
+	}
+
+	if !reflect.DeepEqual(got.Stats(), stats) {
+		t.Errorf("Stats = %+v; want %+v", got.Stats(), stats)
+	}
+
+	if _, err := NewBinsArtifact([][]string{{"missing"}}, BuildStats{TermsPerBin: []uint32{1}}, docIDs, "test", "", config); err == nil {
+		t.Errorf("NewBinsArtifact accepted a doc that isn't in the dictionary")
+	}
+}
+
+func TestBinsReport(t *testing.T) {
+	config := Config{K: 4, D: 1, MaxBins: 4, Threshold: 1}
+	docIDs := []string{"0", "1", "2", "3", "4"}
+	DB := [][]string{{"0", "2"}, {}, {"0", "1", "3"}, {"2"}}
+	stats := BuildStats{Searched: 6, Dropped: 2, TermsPerBin: []uint32{2, 0, 3, 1}}
+
+	art, err := NewBinsArtifact(DB, stats, docIDs, "test", "", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewBinsReport(art, 8, 2)
+
+	if r.EmptyBins != 1 || r.Postings != 6 || r.MaxRowSize != 3 {
+		t.Errorf("EmptyBins, Postings, MaxRowSize = %d, %d, %d; want 1, 6, 3", r.EmptyBins, r.Postings, r.MaxRowSize)
+	}
+	if r.PaddingSlots != 6 || r.PaddedDBBytes != 96 || r.PayloadBytes != 48 {
+		t.Errorf("PaddingSlots, PaddedDBBytes, PayloadBytes = %d, %d, %d; want 6, 96, 48",
+			r.PaddingSlots, r.PaddedDBBytes, r.PayloadBytes)
+	}
+	if r.RowSize != 2 || r.Rows != 5 || r.RowDBBytes != 80 { // the 3 doc bin takes two rows, the empty one still one
+		t.Errorf("RowSize, Rows, RowDBBytes = %d, %d, %d; want 2, 5, 80", r.RowSize, r.Rows, r.RowDBBytes)
+	}
+	// too few bins for two tiers Piano can serve, so one, padded to MinPIREntries entries
+	if want := uint64(MinPIREntries * 3 * 8); !reflect.DeepEqual(r.TierBounds, []int{3}) || !reflect.DeepEqual(r.TierBins, []int{4}) || r.TieredDBBytes != want {
+		t.Errorf("TierBounds, TierBins, TieredDBBytes = %v, %v, %d; want [3], [4], %d", r.TierBounds, r.TierBins, r.TieredDBBytes, want)
+	}
+	if r.UnbinnedDocs != 1 || r.MaxReplication != 2 {
+		t.Errorf("UnbinnedDocs, MaxReplication = %d, %d; want 1, 2", r.UnbinnedDocs, r.MaxReplication)
+	}
+	if r.TermsDropped != 2 || r.CollidingBins != 2 || r.MaxTermsPerBin != 3 {
+		t.Errorf("TermsDropped, CollidingBins, MaxTermsPerBin = %d, %d, %d; want 2, 2, 3",
+			r.TermsDropped, r.CollidingBins, r.MaxTermsPerBin)
+	}
+	want := []HistogramBucket{{0, 1}, {1, 1}, {2, 1}, {3, 1}}
+	if !reflect.DeepEqual(r.BinSizes, want) {
+		t.Errorf("BinSizes = %v; want %v", r.BinSizes, want)
+	}
+}
+
+func TestDocIDEntriesRoundTrip(t *testing.T) {
+	DB := [][]uint32{{0, 2}, {}, {1, 3, 4}}
+	maxRowSize := 3
+
+	codec := EntryCodec{Payload: PayloadDocIDs}
+	words := codec.EntryWords(maxRowSize)
+	if words%4 != 0 || words*8 < EntryHeaderBytes+maxRowSize*DocIDBytes {
+		t.Fatalf("EntryWords(%d) = %d", maxRowSize, words)
+	}
+
+	answers := map[string][][]uint64{}
+	for i, bin := range DB {
+		entry := make([]uint64, words)
+		if err := codec.Encode(entry, bin, nil); err != nil {
+			t.Fatal(err)
+		}
+		got, vectors, err := codec.Decode(entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(bin) || (len(bin) > 0 && !reflect.DeepEqual(got, bin)) || vectors != nil {
+			t.Errorf("bin %d decoded to %v, %v; want %v", i, got, vectors, bin)
+		}
+		answers["q"] = append(answers["q"], entry)
+	}
+
+	// Piano answers a query it had to drop with zeros, which is an empty bin rather than doc 0
+	if got, _, err := codec.Decode(make([]uint64, words)); err != nil || len(got) != 0 {
+		t.Errorf("all-zero entry decoded to %v, %v; want no docs", got, err)
+	}
+
+	// A reused encoder doesn't leak the docs of a bigger entry into the next one
+	enc := codec.NewEncoder()
+	for _, bin := range [][]uint32{{1, 3, 4}, {2}} {
+		entry := make([]uint64, words)
+		if err := enc.Encode(entry, bin, nil); err != nil {
+			t.Fatal(err)
+		}
+		fresh := make([]uint64, words)
+		if err := codec.Encode(fresh, bin, nil); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(entry, fresh) {
+			t.Errorf("reused encoder wrote %x for %v; want %x", entry, bin, fresh)
+		}
+	}
+
+	if err := codec.Encode(make([]uint64, 4), []uint32{1, 2, 3, 4, 5}, nil); err == nil {
+		t.Errorf("Encode accepted more docs than fit in the entry")
+	}
+	q := FitQuantizer([][]float32{{1}}, 1, EncodingFloat32)
+	if _, _, err := (EntryCodec{Payload: PayloadVectors, Quantizer: q}).Decode(answers["q"][0]); err == nil {
+		t.Errorf("decoded a doc ID entry as vectors")
+	}
+	corrupt := append([]uint64(nil), answers["q"][2]...)
+	corrupt[1] += 100 // Count
+	if _, _, err := codec.Decode(corrupt); err == nil {
+		t.Errorf("decoded an entry with more docs than it has room for")
+	}
+}
+
+func TestRowLayout(t *testing.T) {
+	DB := [][]uint32{{0, 2}, {}, {1, 3, 4}}
+	layout, err := NewRowLayout([]int{2, 0, 3}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []uint64{0, 1, 2, 4}; !reflect.DeepEqual(layout.Start, want) {
+		t.Fatalf("Start = %v; want %v, the empty bin still gets a row", layout.Start, want)
+	}
+	if layout.NumRows() != 4 || layout.MaxRun() != 2 || !reflect.DeepEqual(layout.Rows(2), []uint64{2, 3}) {
+		t.Errorf("NumRows, MaxRun, Rows(2) = %d, %d, %v; want 4, 2, [2 3]", layout.NumRows(), layout.MaxRun(), layout.Rows(2))
+	}
+	art := &BinsArtifact{Bins: DB}
+	if AutoRowSize(art) != 3 {
+		t.Errorf("AutoRowSize = %d; want 3", AutoRowSize(art))
+	}
+
+	rows, err := layout.SplitRows(DB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := [][]uint32{{0, 2}, {}, {1, 3}, {4}}; !reflect.DeepEqual(rows, want) {
+		t.Fatalf("SplitRows = %v; want %v", rows, want)
+	}
+	if _, err := layout.SplitRows(DB[:2]); err == nil {
+		t.Errorf("SplitRows accepted fewer bins than the layout has")
+	}
+
+	// The client gets a bin as its rows back to back and decodes them as one
+	codec := EntryCodec{Payload: PayloadDocIDs}
+	codec.RowWords = codec.EntryWords(layout.RowSize)
+	rawDB := make([]uint64, len(rows)*codec.RowWords)
+	for r, row := range rows {
+		if err := codec.Encode(rawDB[r*codec.RowWords:(r+1)*codec.RowWords], row, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	run := rawDB[layout.Start[2]*uint64(codec.RowWords) : layout.Start[3]*uint64(codec.RowWords)]
+	if got, _, err := codec.Decode(run); err != nil || !reflect.DeepEqual(got, DB[2]) {
+		t.Errorf("run of bin 2 decoded to %v, %v; want %v", got, err, DB[2])
+	}
+	if _, _, err := codec.Decode(run[:len(run)-1]); err == nil {
+		t.Errorf("decoded a run that isn't a whole number of rows")
+	}
+}
+
+// Piano only answers len(batch)/PIRPartitions+1 entries of each partition, so a run of rows in consecutive entries
+// used to come back as its first row and zeros. Fetch every bin through a real PIR and make sure all of it arrives.
+func TestRowLayoutPIR(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	sizes := make([]int, 40)
+	DB := make([][]uint32, len(sizes))
+	doc := uint32(0)
+	for b := range sizes {
+		sizes[b] = rng.Intn(8)
+		if b == 7 {
+			sizes[b] = 2*PIRPartitions*2 + 3 // runs over every partition more than once
+		}
+		for j := 0; j < sizes[b]; j++ {
+			DB[b] = append(DB[b], doc)
+			doc++
+		}
+	}
+	layout, err := NewRowLayout(sizes, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layout = layout.Stripe()
+	if layout.Entries() != PIREntries(layout.NumRows()) || layout.Entries()%PIRPartitions != 0 {
+		t.Fatalf("Entries = %d for %d rows; want %d", layout.Entries(), layout.NumRows(), PIREntries(layout.NumRows()))
+	}
+	seen := make(map[uint64]bool)
+	for r := uint64(0); r < uint64(layout.Entries()); r++ {
+		seen[layout.Entry(r)] = true
+	}
+	if len(seen) != layout.Entries() {
+		t.Fatalf("rows map to %d distinct entries; want %d", len(seen), layout.Entries())
+	}
+
+	rows, err := layout.SplitRows(DB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	codec := EntryCodec{Payload: PayloadDocIDs}
+	codec.RowWords = codec.EntryWords(layout.RowSize)
+	rawDB := make([]uint64, len(rows)*codec.RowWords)
+	for r, row := range rows {
+		if err := codec.Encode(rawDB[r*codec.RowWords:(r+1)*codec.RowWords], row, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pir := pianopir.NewSimpleBatchPianoPIR(uint64(len(rows)), uint64(codec.RowWords*8), PIRBatchSize, rawDB, 40)
+	pir.Preprocessing()
+
+	for b := range DB {
+		// every bin costs the same number of queries, whatever its size
+		if n := len(layout.Fetch(uint64(b))); n != layout.MaxRun() {
+			t.Fatalf("bin %d is fetched as %d rows; want %d", b, n, layout.MaxRun())
+		}
+		answers, dropped, err := layout.FetchBins(pir.Query, []uint64{uint64(b)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _, err := codec.Decode(answers[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dropped != 0 || len(got) != len(DB[b]) || (len(got) > 0 && !reflect.DeepEqual(got, DB[b])) {
+			t.Errorf("bin %d (%d rows) came back as %v with %d rows dropped; want %v", b, len(layout.Rows(uint64(b))), got, dropped, DB[b])
+		}
+	}
+}
+
+func TestTierLayout(t *testing.T) {
+	sizes := []int{1, 40, 2, 0, 38, 1, 3, 40}
+	if got := TierBounds(sizes, 1, 0); !reflect.DeepEqual(got, []int{40}) {
+		t.Errorf("TierBounds(1) = %v; want [40]", got)
+	}
+	if got := TierBounds(sizes, 2, 0); !reflect.DeepEqual(got, []int{3, 40}) {
+		t.Errorf("TierBounds(2) = %v; want [3 40]", got)
+	}
+	if got := TierBounds([]int{5, 5}, 3, 0); !reflect.DeepEqual(got, []int{5}) {
+		t.Errorf("TierBounds of one size = %v; want [5]", got)
+	}
+	// the 3 doc bin has to go up with the big ones so they aren't a tier of three
+	if got := TierBounds(sizes, 3, 4); !reflect.DeepEqual(got, []int{2, 40}) {
+		t.Errorf("TierBounds(3) of at least 4 bins = %v; want [2 40]", got)
+	}
+	if got := TierBounds(sizes, 3, 9); !reflect.DeepEqual(got, []int{40}) {
+		t.Errorf("TierBounds of at least more bins than there are = %v; want [40]", got)
+	}
+
+	layout, err := NewTierLayout(sizes, TierBounds(sizes, 2, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := uint64(MinPIREntries*3 + MinPIREntries*40); !reflect.DeepEqual(layout.Counts, []int{5, 3}) || layout.PaddedSlots() != want {
+		t.Errorf("Counts, PaddedSlots = %v, %d; want [5 3], %d", layout.Counts, layout.PaddedSlots(), want)
+	}
+	// the second bin of a tier is in the second partition, the fifth in the fifth
+	part := uint64(MinPIREntries / PIRPartitions)
+	if layout.Tier[4] != 1 || layout.Index[4] != part || layout.Tier[6] != 0 || layout.Index[6] != 4*part {
+		t.Errorf("bin 4 is tier %d entry %d, bin 6 tier %d entry %d; want 1/6 and 0/24",
+			layout.Tier[4], layout.Index[4], layout.Tier[6], layout.Index[6])
+	}
+	if _, err := NewTierLayout(sizes, []int{3, 39}); err == nil {
+		t.Errorf("NewTierLayout accepted a 40 doc bin with tiers up to 39")
+	}
+
+	DB := make([][]uint32, len(sizes))
+	for b, n := range sizes {
+		DB[b] = make([]uint32, n)
+	}
+	tiers, err := layout.Split(DB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tiers[1][part]) != 38 || len(tiers[0][4*part]) != 3 {
+		t.Errorf("Split put %d docs at tier 1 entry 6 and %d at tier 0 entry 24; want 38 and 3", len(tiers[1][part]), len(tiers[0][4*part]))
+	}
+	if len(tiers[0]) != MinPIREntries || len(tiers[1]) != MinPIREntries || tiers[1][3] != nil {
+		t.Errorf("Split made tiers of %d and %d entries; want both padded to %d", len(tiers[0]), len(tiers[1]), MinPIREntries)
+	}
+
+	// Every tier gets the same number of sub-queries, whichever bins are wanted
+	batch := layout.Batch([]uint64{4, 6, 1, 7}, 2, rand.New(rand.NewSource(1)))
+	for tier, indices := range batch.Indices {
+		if len(indices) != 2 || len(batch.Slots[tier]) != 2 {
+			t.Fatalf("tier %d got %d sub-queries; want 2", tier, len(indices))
+		}
+	}
+	if batch.Dropped != 1 {
+		t.Errorf("Dropped = %d; want 1, tier 1 only has room for two of bins 4, 1 and 7", batch.Dropped)
+	}
+	if batch.Indices[0][0] != 4*part || batch.Slots[0][0] != 1 || batch.Slots[0][1] != -1 || batch.Indices[0][1] >= uint64(MinPIREntries) {
+		t.Errorf("tier 0 sub-queries %v for slots %v; want bin 6 (entry 24) for slot 1, then padding", batch.Indices[0], batch.Slots[0])
+	}
+	if !reflect.DeepEqual(batch.Slots[1], []int{0, 2}) {
+		t.Errorf("tier 1 answers slots %v; want [0 2]", batch.Slots[1])
+	}
+}
@@ -0,0 +1,193 @@
+package bins
+
+import (
+	"container/heap"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+
+	"github.com/schollz/progressbar/v3"
+	"github.com/sirupsen/logrus"
+)
+
+// Binning is how docs are put into bins
+type Binning int
+
+const (
+	BinUnigram Binning = iota // MakeUnigramDB: the top-K docs of each term go into the term's hashed bins
+	BinKMeans                 // MakeClusterDB: k-means over the doc vectors, each cluster is a bin
+)
+
+func ParseBinning(s string) (Binning, error) {
+	switch s {
+	case "unigram":
+		return BinUnigram, nil
+	case "kmeans":
+		return BinKMeans, nil
+	}
+	return 0, fmt.Errorf("unknown binning %q, want unigram or kmeans", s)
+}
+
+func (b Binning) String() string {
+	switch b {
+	case BinUnigram:
+		return "unigram"
+	case BinKMeans:
+		return "kmeans"
+	}
+	return fmt.Sprintf("Binning(%d)", int(b))
+}
+
+func (b Binning) MarshalText() ([]byte, error) {
+	return []byte(b.String()), nil
+}
+
+func (b *Binning) UnmarshalText(text []byte) error {
+	v, err := ParseBinning(string(text))
+	if err != nil {
+		return err
+	}
+	*b = v
+	return nil
+}
+
+// ClusterTraining is how MakeClusterDB trains its centroids
+type ClusterTraining struct {
+	Sample int // vectors k-means is trained on, 0 for all of them
+	Iters  int
+	Seed   int64
+}
+
+// MakeClusterDB is the IVF-style alternative to MakeUnigramDB. It runs k-means over the doc vectors with
+// Config.MaxBins clusters and puts every doc into its D+1 nearest clusters, the same way a unigram term goes into D+1
+// hashed bins. rowIDs[i] is the _id of vectors[i]. The centroids have to be published to the client, which probes the
+// bins of the clusters nearest its query embedding (NearestClusters).
+func MakeClusterDB(vectors [][]float32, rowIDs []string, config Config, training ClusterTraining) ([][]string, [][]float32, BuildStats, error) {
+	if config.Binning != BinKMeans {
+		return nil, nil, BuildStats{}, fmt.Errorf("MakeClusterDB: config is for %v binning", config.Binning)
+	}
+	if len(rowIDs) != len(vectors) {
+		return nil, nil, BuildStats{}, fmt.Errorf("MakeClusterDB: %d vectors but %d IDs", len(vectors), len(rowIDs))
+	}
+	if config.MaxBins == 0 || int(config.MaxBins) > len(vectors) {
+		return nil, nil, BuildStats{}, fmt.Errorf("MakeClusterDB: can't make %d clusters from %d vectors", config.MaxBins, len(vectors))
+	}
+
+	train := vectors
+	if training.Sample > 0 && training.Sample < len(vectors) {
+		rng := rand.New(rand.NewSource(training.Seed))
+		train = make([][]float32, training.Sample)
+		for i, j := range rng.Perm(len(vectors))[:training.Sample] {
+			train[i] = vectors[j]
+		}
+	}
+	logrus.Infof("Training %d clusters on %d vectors", config.MaxBins, len(train))
+	centroids := KMeans(train, int(config.MaxBins), training.Iters, training.Seed)
+
+	probes := int(config.D) + 1
+	assign := make([][]uint64, len(vectors))
+	bar := progressbar.Default(int64(len(vectors)), "Assigning clusters")
+
+	workers := config.workers()
+	chunk := (len(vectors) + workers - 1) / workers
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		start, end := w*chunk, min((w+1)*chunk, len(vectors))
+		if start >= end {
+			break
+		}
+		wg.Add(1)
+		go func(start, end int) {
+			defer wg.Done()
+			for i := start; i < end; i++ {
+				assign[i] = NearestClusters(centroids, vectors[i], probes)
+				if done := i + 1 - start; done%1024 == 0 {
+					bar.Add(1024)
+				}
+			}
+			bar.Add((end - start) % 1024)
+		}(start, end)
+	}
+	wg.Wait()
+	bar.Finish()
+
+	DB := make([][]string, config.MaxBins)
+	for i, clusters := range assign {
+		for _, c := range clusters {
+			DB[c] = append(DB[c], rowIDs[i])
+		}
+	}
+	for _, bin := range DB {
+		sort.Strings(bin)
+	}
+
+	// Every bin holds one cluster, the closest thing to a term
+	stats := BuildStats{TermsPerBin: make([]uint32, config.MaxBins)}
+	for i := range stats.TermsPerBin {
+		stats.TermsPerBin[i] = 1
+	}
+
+	return DB, centroids, stats, nil
+}
+
+// NearestClusters returns the n centroids nearest v by squared L2 distance, nearest first. These are the bins the
+// client queries for a query embedding v, or the bins MakeClusterDB puts a doc into.
+func NearestClusters(centroids [][]float32, v []float32, n int) []uint64 {
+	n = min(n, len(centroids))
+	if n == 1 {
+		c, _ := NearestCentroid(centroids, v)
+		return []uint64{uint64(c)}
+	}
+
+	// max-heap of the n nearest so far
+	h := make(clusterHeap, 0, n+1)
+	for c, centroid := range centroids {
+		d := squaredL2(v, centroid)
+		if len(h) < n {
+			heap.Push(&h, clusterDist{c, d})
+		} else if d < h[0].dist {
+			h[0] = clusterDist{c, d}
+			heap.Fix(&h, 0)
+		}
+	}
+
+	out := make([]uint64, len(h))
+	for i := len(out) - 1; i >= 0; i-- {
+		out[i] = uint64(heap.Pop(&h).(clusterDist).cluster)
+	}
+	return out
+}
+
+type clusterDist struct {
+	cluster int
+	dist    float32
+}
+
+type clusterHeap []clusterDist
+
+func (h clusterHeap) Len() int { return len(h) }
+func (h clusterHeap) Less(i, j int) bool {
+	if h[i].dist != h[j].dist {
+		return h[i].dist > h[j].dist
+	}
+	return h[i].cluster > h[j].cluster
+}
+func (h clusterHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *clusterHeap) Push(x any)   { *h = append(*h, x.(clusterDist)) }
+func (h *clusterHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// CentroidsChecksum identifies a set of centroids, so the bins artifact can make sure the client probes with the
+// centroids the bins were built from
+func CentroidsChecksum(centroids [][]float32) string {
+	flat := []float32{float32(len(centroids))}
+	for _, c := range centroids {
+		flat = append(flat, c...)
+	}
+	return HashFloat32s(flat)
+}
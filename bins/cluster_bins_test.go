@@ -0,0 +1,118 @@
+package bins
+
+import (
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestMakeClusterDB(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	centres := [][]float32{{0, 0}, {20, 0}, {0, 20}, {20, 20}}
+	vectors := make([][]float32, 200)
+	rowIDs := make([]string, len(vectors))
+	for i := range vectors {
+		c := centres[i%len(centres)]
+		vectors[i] = []float32{c[0] + float32(rng.NormFloat64()), c[1] + float32(rng.NormFloat64())}
+		rowIDs[i] = strconv.Itoa(i)
+	}
+
+	config := Config{Binning: BinKMeans, D: 1, MaxBins: 4, Workers: 3}
+	DB, centroids, stats, err := MakeClusterDB(vectors, rowIDs, config, ClusterTraining{Sample: 100, Iters: 20, Seed: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(DB) != 4 || len(centroids) != 4 || len(stats.TermsPerBin) != 4 {
+		t.Fatalf("got %d bins, %d centroids, %d TermsPerBin; want 4 of each", len(DB), len(centroids), len(stats.TermsPerBin))
+	}
+
+	// D=1: every doc lands in its 2 nearest clusters, the first of which is the nearest
+	seen := make(map[string][]int)
+	for b, bin := range DB {
+		for _, id := range bin {
+			seen[id] = append(seen[id], b)
+		}
+	}
+	for i, v := range vectors {
+		bins := seen[rowIDs[i]]
+		if len(bins) != 2 {
+			t.Fatalf("doc %d is in bins %v; want 2 bins", i, bins)
+		}
+		nearest := NearestClusters(centroids, v, 2)
+		nearest0, _ := NearestCentroid(centroids, v)
+		if int(nearest[0]) != nearest0 {
+			t.Errorf("NearestClusters(doc %d)[0] = %d; NearestCentroid says %d", i, nearest[0], nearest0)
+		}
+		got := map[int]bool{bins[0]: true, bins[1]: true}
+		if !got[int(nearest[0])] || !got[int(nearest[1])] {
+			t.Errorf("doc %d is in bins %v; want %v", i, bins, nearest)
+		}
+	}
+
+	// The same seed builds the same bins
+	again, _, _, err := MakeClusterDB(vectors, rowIDs, config, ClusterTraining{Sample: 100, Iters: 20, Seed: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(again, DB) {
+		t.Errorf("MakeClusterDB isn't deterministic")
+	}
+
+	// The client gets the centroids as a .npy
+	path := filepath.Join(t.TempDir(), "centroids.npy")
+	if err := WriteFloat32Npy(path, centroids); err != nil {
+		t.Fatal(err)
+	}
+	read, err := LoadFloat32Npy(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if CentroidsChecksum(read) != CentroidsChecksum(centroids) {
+		t.Errorf("centroids changed in the .npy round trip: %v vs %v", read, centroids)
+	}
+
+	if _, _, _, err := MakeClusterDB(vectors, rowIDs, Config{MaxBins: 4}, ClusterTraining{}); err == nil {
+		t.Errorf("MakeClusterDB accepted a unigram config")
+	}
+}
+
+func TestHybrid(t *testing.T) {
+	docIDs := []string{"a", "b", "c"}
+	lexical, err := NewBinsArtifact([][]string{{"a"}, {"b", "c"}}, BuildStats{TermsPerBin: []uint32{1, 2}}, docIDs, "test", "sum",
+		Config{K: 2, D: 1, MaxBins: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cluster, err := NewBinsArtifact([][]string{{"a", "b"}, {"c"}, {}}, BuildStats{TermsPerBin: []uint32{1, 1, 1}}, docIDs, "test", "sum",
+		Config{D: 0, MaxBins: 3, Binning: BinKMeans})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cluster.Header.Centroids = "centroids"
+
+	hybrid, layout, err := NewHybridArtifact(lexical, cluster)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if layout.LexicalBins != 2 || layout.ClusterBins != 3 || layout.ClusterIndex(1) != 3 {
+		t.Errorf("layout = %+v", layout)
+	}
+	want := [][]uint32{{0}, {1, 2}, {0, 1}, {2}, {}}
+	if !reflect.DeepEqual(hybrid.Bins, want) {
+		t.Errorf("hybrid bins = %v; want %v", hybrid.Bins, want)
+	}
+	if hybrid.Header.Centroids != "centroids" || len(hybrid.TermsPerBin) != 5 {
+		t.Errorf("hybrid header = %+v, TermsPerBin %v", hybrid.Header, hybrid.TermsPerBin)
+	}
+	if _, _, err := NewHybridArtifact(cluster, lexical); err == nil {
+		t.Errorf("NewHybridArtifact accepted the tables the wrong way round")
+	}
+
+	// "b" is in both tables, "a" in half the lexical bins, "c" and "d" only in one table
+	fused := FuseHybridQuery([]string{"a", "b"}, []string{"b", "c", "d"}, 2, 1)
+	if want := []string{"b", "c", "d", "a"}; !reflect.DeepEqual(fused, want) {
+		t.Errorf("FuseHybridQuery = %v; want %v", fused, want)
+	}
+}
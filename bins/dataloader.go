@@ -46,11 +46,8 @@ type DatasetMetadata struct {
 	Qrels       string
 }
 
+// LoadBeirJSONL indexes a BEIR corpus.jsonl, or an MS MARCO collection.tsv, into indexDir
 func LoadBeirJSONL(path, indexDir string) {
-	f, err := os.Open(path)
-	Must(err)
-	defer f.Close()
-
 	var counter = 0
 
 	cfg := bluge.DefaultConfig(indexDir)
@@ -60,88 +57,69 @@ func LoadBeirJSONL(path, indexDir string) {
 
 	bar := progressbar.Default(-1, "index "+indexDir) // unknown total
 
-	sc := bufio.NewScanner(f)
-	sc.Buffer(make([]byte, 1024*1024), 10*1024*1024) // 1 MiB buf, 10 MiB max
-
-	for sc.Scan() {
-		bar.Add64(int64(len(sc.Bytes()) + 1)) // +1 for '\n'
-
-		// use a Decoder so we can catch unknown fields
-		raw := sc.Bytes()
-		dec := json.NewDecoder(bytes.NewReader(sc.Bytes()))
-		dec.DisallowUnknownFields()
-
-		var d beirDoc
-		if err := dec.Decode(&d); err != nil {
-			// if it's an unknown‐field error, log it and continue
-			if strings.HasPrefix(err.Error(), "json: unknown field") {
-				logrus.Tracef("⚠️  unknown JSON field in line: %v", err)
-				logrus.Tracef("Raw JSON line: %s", raw)
-			}
-		}
+	// BEIR corpora often have fields beirDoc doesn't, that's only worth a trace while indexing
+	Must(streamCorpusWithHash(path, nil, logrus.TraceLevel, func(d beirDoc) error {
+		bar.Add(1)
 
-		// now index as before
 		doc := bluge.NewDocument(d.ID)
 		doc.AddField(bluge.NewTextField("title", d.Title))
-
-		body := d.Text
-		if body == "" {
-			body = d.Abstract
-		}
-		doc.AddField(bluge.NewTextField("body", body))
+		doc.AddField(bluge.NewTextField("body", d.Text))
 		doc.AddField(bluge.NewKeywordField("dataset", indexDir))
 
-		Must(w.Insert(doc))
 		counter++
-	}
-	if err := sc.Err(); err != nil {
-		log.Fatal(err)
-	}
+		return w.Insert(doc)
+	}))
 	bar.Finish()
 
 	logrus.Debugf("Total documents: %d", counter)
 }
 
-// Taken from graphann package. I think dim should be 192 and n should be 8841823 (ms marco size)
-func LoadFloat32MatrixFromNpy(filename string, n int, dim int) ([][]float32, error) {
-	r, err := gonpy.NewFileReader(filename)
+// Taken from graphann package. I think dim should be 192 and n should be 8841823 (ms marco size). Only the first n rows
+// are loaded, memory-mapped when the file is float32 in C order (see LoadNpyMatrix).
+func LoadFloat32MatrixFromNpy(filename string, n int, dim int) (*Matrix, error) {
+	h, err := ReadNpyHeader(filename)
 	if err != nil {
-		fmt.Println(err)
 		return nil, err
 	}
 
-	shape := r.Shape
-
 	// check the shape
-	if len(shape) != 2 || shape[0] < n || shape[1] != dim {
-		fmt.Printf("Invalid shape: %v\n", shape)
-		fmt.Printf("Expected shape: (%d, %d)\n", n, dim)
-		return nil, fmt.Errorf("invalid shape: %v", shape)
+	if shape := h.Shape; len(shape) != 2 || shape[0] < n || shape[1] != dim {
+		return nil, fmt.Errorf("%s: invalid shape %v, expected at least (%d, %d)", filename, shape, n, dim)
 	}
 
-	data, err := r.GetFloat32()
+	return LoadNpyMatrix(filename, 0, n)
+}
 
-	// data, err := r.GetFloat64()
+// LoadFloat32Npy loads a 2-d float .npy of any number of rows, like the centroids WriteFloat32Npy writes, a file of
+// query embeddings, or the float64 Fortran order matrices numpy gives for PCA/SVD outputs
+func LoadFloat32Npy(filename string) ([][]float32, error) {
+	m, err := LoadNpyMatrix(filename, 0, -1)
 	if err != nil {
-		fmt.Println(err)
 		return nil, err
 	}
+	return m.RowViews(), nil
+}
 
-	bar := progressbar.Default(int64(n), "Loading BM25 vectors")
-
-	// we now convert the data to a 2D slice
-	ret := make([][]float32, n)
-	for i := 0; i < n; i++ {
-		ret[i] = make([]float32, dim)
-		for j := 0; j < dim; j++ {
-			ret[i][j] = float32(data[i*dim+j])
+// WriteFloat32Npy writes the rows of m (all the same length) as a 2-d float32 .npy
+func WriteFloat32Npy(filename string, m [][]float32) error {
+	dim := 0
+	if len(m) > 0 {
+		dim = len(m[0])
+	}
+	data := make([]float32, 0, len(m)*dim)
+	for i, row := range m {
+		if len(row) != dim {
+			return fmt.Errorf("WriteFloat32Npy: row %d has %d columns, want %d", i, len(row), dim)
 		}
-		bar.Add64(int64(1))
+		data = append(data, row...)
 	}
 
-	bar.Finish()
-
-	return ret, nil
+	w, err := gonpy.NewFileWriter(filename)
+	if err != nil {
+		return err
+	}
+	w.Shape = []int{len(m), dim}
+	return w.WriteFloat32(data)
 }
 
 type Query struct {
@@ -152,48 +130,17 @@ type Query struct {
 
 type qrels map[string]map[string]int
 
+// LoadCorpus reads every document into memory, prefer StreamCorpus for anything the size of MS MARCO
 func LoadCorpus(path string) ([]beirDoc, error) {
-	f, err := os.Open(path)
-	Must(err)
-	defer f.Close()
-
-	var counter = 0
-
 	var ds []beirDoc
-	sc := bufio.NewScanner(f)
-
-	sc.Buffer(make([]byte, 1024), 10*1024*1024) // max 10 mib, should be fine (I hope)
-	for sc.Scan() {
-		raw := sc.Bytes()
-		dec := json.NewDecoder(bytes.NewReader(sc.Bytes()))
-		dec.DisallowUnknownFields()
-
-		var d beirDoc
-		if err := dec.Decode(&d); err != nil {
-			// if it's an unknown‐field error, log it and continue
-			if strings.HasPrefix(err.Error(), "json: unknown field") {
-				logrus.Errorf("⚠️  unknown JSON field in line: %v", err)
-				logrus.Errorf("Raw JSON line: %s", raw)
-			}
-		}
-
-		body := d.Text
-		if body == "" {
-			body = d.Abstract
-		}
-
-		document := beirDoc{
-			ID:    d.ID,
-			Title: d.Title,
-			Text:  body,
-		}
-
-		ds = append(ds, document)
-		counter++
-	}
-	return ds, sc.Err()
+	err := StreamCorpus(path, func(doc beirDoc) error {
+		ds = append(ds, doc)
+		return nil
+	})
+	return ds, err
 }
 
+// LoadQueries reads a BEIR queries.jsonl or an MS MARCO queries.*.tsv (qid<TAB>query)
 func LoadQueries(path string) ([]Query, error) {
 	f, err := os.Open(path)
 	if err != nil {
@@ -204,10 +151,23 @@ func LoadQueries(path string) ([]Query, error) {
 	var counter = 0
 
 	var qs []Query
-	sc := bufio.NewScanner(f)
+	br := bufio.NewReader(f)
+	jsonl := isJSONL(br)
+	sc := bufio.NewScanner(br)
 	// allow long queries
 	sc.Buffer(make([]byte, 1024), 1024*1024)
-	for sc.Scan() {
+	for line := 1; sc.Scan(); line++ {
+		if !jsonl {
+			if len(bytes.TrimSpace(sc.Bytes())) == 0 {
+				continue
+			}
+			q, err := parseQueryLine(sc.Text())
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+			}
+			qs = append(qs, q)
+			continue
+		}
 		raw := sc.Bytes()
 		dec := json.NewDecoder(bytes.NewReader(sc.Bytes()))
 		dec.DisallowUnknownFields()
@@ -225,12 +185,13 @@ func LoadQueries(path string) ([]Query, error) {
 			qs = append(qs, q)
 			counter++
 		} else {
-			logrus.Error("Query not added, error: %v", err)
+			logrus.Errorf("Query not added, error: %v", err)
 		}
 	}
 	return qs, sc.Err()
 }
 
+// loadQrels reads BEIR qrels (query-id, corpus-id, score, with a header) or TREC qrels (qid 0 docid relevance)
 func loadQrels(path string) (qrels, error) {
 	f, err := os.Open(path)
 	if err != nil {
@@ -246,6 +207,10 @@ func loadQrels(path string) (qrels, error) {
 			continue
 		}
 		qid, docid, score := line[0], line[1], line[2]
+		if len(line) == 4 {
+			// TREC style, e.g. MS MARCO's qrels.*.txt: qid, iteration (always 0), docid, relevance
+			docid, score = line[2], line[3]
+		}
 		v, _ := strconv.Atoi(score)
 		if v <= 0 {
 			continue
@@ -0,0 +1,133 @@
+package bins
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// DocRows maps corpus _ids to rows of the doc vector matrix and back. Vector files don't carry the _ids, so they come
+// from a sidecar with one _id per line, row order (VectorIDsPath), or without one row i is taken to be _id i, which is
+// how the MS MARCO vectors are laid out.
+type DocRows struct {
+	ids  []string       // nil for the identity mapping
+	rows map[string]int // nil for the identity mapping
+	n    int
+}
+
+// VectorIDsPath is where the _id sidecar of a vectors file goes, e.g. vectors.npy.id
+func VectorIDsPath(vectorsPath string) string {
+	return vectorsPath + ".id"
+}
+
+// NewDocRows maps row i to ids[i], which have to be distinct and non-empty
+func NewDocRows(ids []string) (*DocRows, error) {
+	d := &DocRows{ids: ids, rows: make(map[string]int, len(ids)), n: len(ids)}
+	for row, id := range ids {
+		if id == "" {
+			return nil, fmt.Errorf("NewDocRows: row %d has no _id", row)
+		}
+		if prev, ok := d.rows[id]; ok {
+			return nil, fmt.Errorf("NewDocRows: rows %d and %d are both _id %s", prev, row, id)
+		}
+		d.rows[id] = row
+	}
+	return d, nil
+}
+
+// IdentityDocRows maps row i to _id i, for n rows
+func IdentityDocRows(n int) *DocRows {
+	return &DocRows{n: n}
+}
+
+// LoadDocRows reads the _id sidecar at path for the first n rows of a vectors file. It has to have an _id for each of
+// them; any lines after that are for rows that weren't loaded.
+func LoadDocRows(path string, n int) (*DocRows, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ids := make([]string, 0, n)
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 1024), 1024*1024)
+	for len(ids) < n && sc.Scan() {
+		ids = append(ids, strings.TrimSpace(sc.Text()))
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(ids) < n {
+		return nil, fmt.Errorf("%s: has %d _ids, but there are %d vectors", path, len(ids), n)
+	}
+	d, err := NewDocRows(ids)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return d, nil
+}
+
+// Len is the number of rows
+func (d *DocRows) Len() int {
+	return d.n
+}
+
+// ID is the _id of row
+func (d *DocRows) ID(row int) string {
+	if d.ids == nil {
+		return strconv.Itoa(row)
+	}
+	return d.ids[row]
+}
+
+// IDs is the _id of every row, in row order
+func (d *DocRows) IDs() []string {
+	if d.ids != nil {
+		return d.ids
+	}
+	ids := make([]string, d.n)
+	for row := range ids {
+		ids[row] = strconv.Itoa(row)
+	}
+	return ids
+}
+
+// Row is the row of _id, false if there is no vector for it
+func (d *DocRows) Row(id string) (int, bool) {
+	if d.rows != nil {
+		row, ok := d.rows[id]
+		return row, ok
+	}
+	row, err := strconv.Atoi(id)
+	// only the canonical spelling, so "007" isn't row 7
+	if err != nil || row < 0 || row >= d.n || strconv.Itoa(row) != id {
+		return 0, false
+	}
+	return row, true
+}
+
+// Rows looks up the row of each of ids, e.g. the doc dictionary of a bins artifact, so that PIR entries can be encoded
+// by doc index. Every _id has to have a vector.
+func (d *DocRows) Rows(ids []string) ([]uint32, error) {
+	rows := make([]uint32, len(ids))
+	missing := 0
+	first := ""
+	for i, id := range ids {
+		row, ok := d.Row(id)
+		if !ok {
+			if missing == 0 {
+				first = id
+			}
+			missing++
+			continue
+		}
+		rows[i] = uint32(row)
+	}
+	if missing > 0 {
+		return nil, fmt.Errorf("%d of %d docs have no vector, e.g. _id %s", missing, len(ids), first)
+	}
+	return rows, nil
+}
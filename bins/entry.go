@@ -0,0 +1,228 @@
+package bins
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// EntryVersion is the version of the PIR entry layout EntryCodec writes. An all-zero entry (version 0) is what Piano
+// answers for a query it had to drop, so it decodes as an empty bin rather than an error.
+const EntryVersion = 1
+
+// EntryHeaderBytes is the size of the header at the start of every PIR entry:
+//
+//	byte 0      version
+//	byte 1      payload (PayloadVectors or PayloadDocIDs)
+//	byte 2      vector encoding, 0 for PayloadDocIDs
+//	byte 3      reserved, 0
+//	bytes 4-7   dimension, 0 for PayloadDocIDs
+//	bytes 8-11  docs in the entry
+//	bytes 12-15 bytes per doc slot
+//
+// all little-endian. The docs follow it back to back and the rest of the entry is zeros.
+const EntryHeaderBytes = 16
+
+// EntryHeader is the decoded header of a PIR entry
+type EntryHeader struct {
+	Version   uint8
+	Payload   Payload
+	Encoding  VectorEncoding
+	Dim       int
+	Count     int
+	SlotBytes int
+}
+
+// EntryCodec writes a bin into a PIR entry and reads it back. Each doc is a slot holding its index into the bins
+// artifact doc dictionary (DocIDBytes bytes), followed for PayloadVectors by its vector encoded with Quantizer. When a
+// bin spans several PIR rows (see RowLayout) each row is an entry of its own, and the client decodes the bin from its
+// rows back to back.
+type EntryCodec struct {
+	Payload   Payload
+	Quantizer *Quantizer // PayloadVectors only
+	RowWords  int        // words per PIR row when bins span several rows, 0 when every bin is one entry
+}
+
+// SlotBytes is the size of one doc in an entry
+func (c EntryCodec) SlotBytes() int {
+	if c.Payload == PayloadVectors {
+		return DocIDBytes + c.Quantizer.BytesPerDoc()
+	}
+	return DocIDBytes
+}
+
+// EntryWords is the number of uint64s in an entry of up to maxRowSize docs, see EntryBytes
+func (c EntryCodec) EntryWords(maxRowSize int) int {
+	return EntryBytes(maxRowSize, c.SlotBytes()) / 8
+}
+
+// EntryBytes is the size of an entry of up to maxRowSize slots of slotBytes, header included. Piano wants entries to be
+// a multiple of 32 bytes, so it's rounded up.
+func EntryBytes(maxRowSize int, slotBytes int) int {
+	return (EntryHeaderBytes + maxRowSize*slotBytes + 31) / 32 * 32
+}
+
+func (c EntryCodec) header(count int) EntryHeader {
+	h := EntryHeader{Version: EntryVersion, Payload: c.Payload, Count: count, SlotBytes: c.SlotBytes()}
+	if c.Payload == PayloadVectors {
+		h.Encoding, h.Dim = c.Quantizer.Encoding, c.Quantizer.Dim
+	}
+	return h
+}
+
+// Encode writes docs, and for PayloadVectors their vectors (vectors[j] is the vector of docs[j]), into entry, which has
+// to be zeroed and hold EntryWords words
+func (c EntryCodec) Encode(entry []uint64, docs []uint32, vectors [][]float32) error {
+	if c.Payload == PayloadVectors && len(vectors) != len(docs) {
+		return fmt.Errorf("EntryCodec.Encode: %d docs but %d vectors", len(docs), len(vectors))
+	}
+	return c.NewEncoder().Encode(entry, docs, func(j int) []float32 { return vectors[j] })
+}
+
+// EntryEncoder is EntryCodec.Encode reusing one buffer, so encoding a whole DB doesn't allocate per entry. Give each
+// goroutine its own.
+type EntryEncoder struct {
+	codec EntryCodec
+	buf   []byte
+}
+
+func (c EntryCodec) NewEncoder() *EntryEncoder {
+	return &EntryEncoder{codec: c}
+}
+
+// Encode is EntryCodec.Encode, with vector(j) the vector of docs[j] (not called for PayloadDocIDs). Only the words the
+// header and slots cover are written, the rest of entry has to be zero already.
+func (e *EntryEncoder) Encode(entry []uint64, docs []uint32, vector func(j int) []float32) error {
+	c := e.codec
+	h := c.header(len(docs))
+	used := EntryHeaderBytes + len(docs)*h.SlotBytes
+	if used > len(entry)*8 {
+		return fmt.Errorf("EntryCodec.Encode: %d docs don't fit in %d words", len(docs), len(entry))
+	}
+
+	n := (used + 7) / 8 * 8
+	if cap(e.buf) < n {
+		e.buf = make([]byte, n)
+	}
+	buf := e.buf[:n]
+	clear(buf)
+	buf[0], buf[1], buf[2] = h.Version, byte(h.Payload), byte(h.Encoding)
+	binary.LittleEndian.PutUint32(buf[4:], uint32(h.Dim))
+	binary.LittleEndian.PutUint32(buf[8:], uint32(h.Count))
+	binary.LittleEndian.PutUint32(buf[12:], uint32(h.SlotBytes))
+	for j, doc := range docs {
+		slot := buf[EntryHeaderBytes+j*h.SlotBytes:]
+		binary.LittleEndian.PutUint32(slot, doc)
+		if c.Payload == PayloadVectors {
+			c.Quantizer.Encode(slot[DocIDBytes:h.SlotBytes], vector(j))
+		}
+	}
+
+	for k := 0; k < n/8; k++ {
+		entry[k] = binary.LittleEndian.Uint64(buf[k*8:])
+	}
+	return nil
+}
+
+// ReadEntryHeader decodes the header at the start of entry
+func ReadEntryHeader(entry []uint64) (EntryHeader, error) {
+	if len(entry)*8 < EntryHeaderBytes {
+		return EntryHeader{}, fmt.Errorf("entry of %d words is too short for a header", len(entry))
+	}
+	var buf [EntryHeaderBytes]byte
+	binary.LittleEndian.PutUint64(buf[0:], entry[0])
+	binary.LittleEndian.PutUint64(buf[8:], entry[1])
+	return EntryHeader{
+		Version:   buf[0],
+		Payload:   Payload(buf[1]),
+		Encoding:  VectorEncoding(buf[2]),
+		Dim:       int(binary.LittleEndian.Uint32(buf[4:])),
+		Count:     int(binary.LittleEndian.Uint32(buf[8:])),
+		SlotBytes: int(binary.LittleEndian.Uint32(buf[12:])),
+	}, nil
+}
+
+// Split reads an entry (or with RowWords, a run of rows) into its doc indices and, for PayloadVectors, their still
+// encoded vectors (see Quantizer.Scorer). The header has to match the codec, so an entry is never decoded with the
+// wrong layout.
+func (c EntryCodec) Split(entry []uint64) ([]uint32, [][]byte, error) {
+	if c.Payload == PayloadVectors {
+		if err := c.Quantizer.ready(); err != nil {
+			return nil, nil, err
+		}
+	}
+	if c.RowWords == 0 || len(entry) <= c.RowWords {
+		return c.splitRow(entry)
+	}
+	if len(entry)%c.RowWords != 0 {
+		return nil, nil, fmt.Errorf("run of %d words isn't a whole number of %d word rows", len(entry), c.RowWords)
+	}
+
+	var docs []uint32
+	var codes [][]byte
+	for off := 0; off < len(entry); off += c.RowWords {
+		d, cs, err := c.splitRow(entry[off : off+c.RowWords])
+		if err != nil {
+			return nil, nil, fmt.Errorf("row %d: %w", off/c.RowWords, err)
+		}
+		docs, codes = append(docs, d...), append(codes, cs...)
+	}
+	return docs, codes, nil
+}
+
+func (c EntryCodec) splitRow(entry []uint64) ([]uint32, [][]byte, error) {
+	h, err := ReadEntryHeader(entry)
+	if err != nil {
+		return nil, nil, err
+	}
+	if h == (EntryHeader{}) {
+		return nil, nil, nil
+	}
+	if h.Version != EntryVersion {
+		return nil, nil, fmt.Errorf("entry version %d, want %d", h.Version, EntryVersion)
+	}
+	if want := c.header(h.Count); h != want {
+		return nil, nil, fmt.Errorf("entry is %v/%v dim %d with %d byte slots, want %v/%v dim %d with %d byte slots",
+			h.Payload, h.Encoding, h.Dim, h.SlotBytes, want.Payload, want.Encoding, want.Dim, want.SlotBytes)
+	}
+	if EntryHeaderBytes+h.Count*h.SlotBytes > len(entry)*8 {
+		return nil, nil, fmt.Errorf("entry says it has %d docs, but only has room for %d",
+			h.Count, (len(entry)*8-EntryHeaderBytes)/h.SlotBytes)
+	}
+
+	buf := make([]byte, len(entry)*8)
+	for k, w := range entry {
+		binary.LittleEndian.PutUint64(buf[k*8:], w)
+	}
+	docs := make([]uint32, h.Count)
+	var codes [][]byte
+	if c.Payload == PayloadVectors {
+		codes = make([][]byte, h.Count)
+	}
+	for j := range docs {
+		slot := buf[EntryHeaderBytes+j*h.SlotBytes : EntryHeaderBytes+(j+1)*h.SlotBytes]
+		docs[j] = binary.LittleEndian.Uint32(slot)
+		if codes != nil {
+			codes[j] = slot[DocIDBytes:]
+			if q := c.Quantizer; q.Encoding == EncodingPQ && q.Codebook != nil {
+				if err := q.Codebook.checkCode(codes[j]); err != nil {
+					return nil, nil, fmt.Errorf("doc %d of the entry: %w", j, err)
+				}
+			}
+		}
+	}
+	return docs, codes, nil
+}
+
+// Decode is Split with the vectors decoded, nil for PayloadDocIDs
+func (c EntryCodec) Decode(entry []uint64) ([]uint32, [][]float32, error) {
+	docs, codes, err := c.Split(entry)
+	if err != nil || codes == nil {
+		return docs, nil, err
+	}
+	vectors := make([][]float32, len(codes))
+	for j, code := range codes {
+		vectors[j] = make([]float32, c.Quantizer.Dim)
+		c.Quantizer.Decode(vectors[j], code)
+	}
+	return docs, vectors, nil
+}
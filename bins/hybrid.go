@@ -0,0 +1,69 @@
+package bins
+
+import "fmt"
+
+// HybridLayout is where each table sits in a hybrid PIR DB: the lexical (BinUnigram) bins are indices
+// [0, LexicalBins) and the cluster (BinKMeans) bins follow them. The client needs it to turn token bins and clusters
+// into PIR indices, and since both go in the same batch the server can't tell which table an index is for.
+type HybridLayout struct {
+	LexicalBins uint64
+	ClusterBins uint64
+}
+
+// ClusterIndex is the PIR index of cluster c
+func (l HybridLayout) ClusterIndex(c uint64) uint64 {
+	return l.LexicalBins + c
+}
+
+// NewHybridArtifact puts a unigram and a cluster artifact built over the same corpus into one table, lexical bins
+// first. The result is only meant for PIR, it isn't a valid artifact to write out.
+func NewHybridArtifact(lexical, cluster *BinsArtifact) (*BinsArtifact, HybridLayout, error) {
+	if lexical.Header.Config.Binning != BinUnigram || cluster.Header.Config.Binning != BinKMeans {
+		return nil, HybridLayout{}, fmt.Errorf("NewHybridArtifact: want unigram and kmeans bins, got %v and %v",
+			lexical.Header.Config.Binning, cluster.Header.Config.Binning)
+	}
+	if lexical.Header.CorpusChecksum != cluster.Header.CorpusChecksum || len(lexical.DocIDs) != len(cluster.DocIDs) {
+		return nil, HybridLayout{}, fmt.Errorf("NewHybridArtifact: the lexical and cluster bins were built from different corpora")
+	}
+	for i := range lexical.DocIDs {
+		if lexical.DocIDs[i] != cluster.DocIDs[i] {
+			return nil, HybridLayout{}, fmt.Errorf("NewHybridArtifact: doc %d is %q in the lexical bins but %q in the cluster bins",
+				i, lexical.DocIDs[i], cluster.DocIDs[i])
+		}
+	}
+
+	layout := HybridLayout{LexicalBins: uint64(len(lexical.Bins)), ClusterBins: uint64(len(cluster.Bins))}
+
+	hybrid := &BinsArtifact{
+		Header:      lexical.Header,
+		DocIDs:      lexical.DocIDs,
+		Bins:        append(append(make([][]uint32, 0, len(lexical.Bins)+len(cluster.Bins)), lexical.Bins...), cluster.Bins...),
+		TermsPerBin: append(append(make([]uint32, 0, len(lexical.Bins)+len(cluster.Bins)), lexical.TermsPerBin...), cluster.TermsPerBin...),
+	}
+	hybrid.Header.NumBins = len(hybrid.Bins)
+	hybrid.Header.Config.MaxBins = uint(len(hybrid.Bins))
+	hybrid.Header.Centroids = cluster.Header.Centroids
+
+	return hybrid, layout, nil
+}
+
+// FuseHybridQuery merges one query's lexical and cluster results. lexical holds the docs of every lexical bin the
+// query fetched (lexicalBins of them), duplicates included, and the same for cluster. A doc scores the fraction of
+// fetched bins it was in, summed over both tables, so docs both tables agree on come first; ties keep the order the
+// docs were first seen in, lexical first. Each doc appears once.
+func FuseHybridQuery(lexical, cluster []string, lexicalBins, clusterBins int) []string {
+	score := make(map[string]float64)
+	var order []string
+	for _, source := range []struct {
+		docs []string
+		bins int
+	}{{lexical, lexicalBins}, {cluster, clusterBins}} {
+		for _, doc := range source.docs {
+			if _, ok := score[doc]; !ok {
+				order = append(order, doc)
+			}
+			score[doc] += 1 / float64(max(source.bins, 1))
+		}
+	}
+	return sortByScore(order, score)
+}
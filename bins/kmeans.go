@@ -0,0 +1,165 @@
+package bins
+
+import (
+	"math"
+	"math/rand"
+	"runtime"
+	"sync"
+)
+
+// KMeans clusters points into k centroids with Lloyd's algorithm, seeded from seed so the same points always give the
+// same centroids. Small problems start from k-means++, which needs k passes over the points, so large ones (thousands
+// of clusters) start from k random points instead. A cluster that ends up empty is re-seeded with the point furthest
+// from its centroid. Fewer than k points just gives one centroid per point.
+func KMeans(points [][]float32, k int, iters int, seed int64) [][]float32 {
+	if len(points) == 0 || k <= 0 {
+		return nil
+	}
+	k = min(k, len(points))
+	dim := len(points[0])
+	rng := rand.New(rand.NewSource(seed))
+
+	var centroids [][]float32
+	if k*len(points) <= kmeansPlusPlusLimit {
+		centroids = kmeansPlusPlus(points, k, rng)
+	} else {
+		for _, i := range rng.Perm(len(points))[:k] {
+			centroids = append(centroids, append([]float32(nil), points[i]...))
+		}
+	}
+
+	assign := make([]int, len(points))
+	dists := make([]float32, len(points))
+	for it := 0; it < iters; it++ {
+		changed := assignNearest(points, centroids, assign, dists)
+		if it > 0 && changed == 0 {
+			break
+		}
+
+		sums := make([][]float64, k)
+		counts := make([]int, k)
+		for c := range sums {
+			sums[c] = make([]float64, dim)
+		}
+		for i, p := range points {
+			c := assign[i]
+			counts[c]++
+			for j, x := range p {
+				sums[c][j] += float64(x)
+			}
+		}
+
+		for c := range centroids {
+			if counts[c] == 0 {
+				far := 0
+				for i := range dists {
+					if dists[i] > dists[far] {
+						far = i
+					}
+				}
+				centroids[c] = append([]float32(nil), points[far]...)
+				dists[far] = 0
+				continue
+			}
+			for j := range centroids[c] {
+				centroids[c][j] = float32(sums[c][j] / float64(counts[c]))
+			}
+		}
+	}
+
+	return centroids
+}
+
+// kmeansPlusPlusLimit is the most k*len(points) KMeans will seed with k-means++
+const kmeansPlusPlusLimit = 1 << 28
+
+// kmeansPlusPlus picks k starting centroids, each one chosen with probability proportional to its squared distance from
+// the centroids picked so far
+func kmeansPlusPlus(points [][]float32, k int, rng *rand.Rand) [][]float32 {
+	centroids := make([][]float32, 0, k)
+	centroids = append(centroids, append([]float32(nil), points[rng.Intn(len(points))]...))
+
+	dists := make([]float64, len(points))
+	for i, p := range points {
+		dists[i] = float64(squaredL2(p, centroids[0]))
+	}
+	for len(centroids) < k {
+		total := 0.0
+		for _, d := range dists {
+			total += d
+		}
+
+		next := rng.Intn(len(points)) // every point is already a centroid, duplicates are the best we can do
+		if total > 0 {
+			target := rng.Float64() * total
+			for i, d := range dists {
+				target -= d
+				if target <= 0 && d > 0 {
+					next = i
+					break
+				}
+			}
+		}
+
+		c := append([]float32(nil), points[next]...)
+		centroids = append(centroids, c)
+		for i, p := range points {
+			dists[i] = math.Min(dists[i], float64(squaredL2(p, c)))
+		}
+	}
+	return centroids
+}
+
+// assignNearest sets assign[i] to the centroid nearest points[i] (and dists[i] to the squared distance to it), split
+// over GOMAXPROCS goroutines. It returns how many assignments changed.
+func assignNearest(points [][]float32, centroids [][]float32, assign []int, dists []float32) int {
+	workers := runtime.GOMAXPROCS(0)
+	chunk := (len(points) + workers - 1) / workers
+
+	var wg sync.WaitGroup
+	changed := make([]int, workers)
+	for w := 0; w < workers; w++ {
+		start, end := w*chunk, min((w+1)*chunk, len(points))
+		if start >= end {
+			break
+		}
+		wg.Add(1)
+		go func(w, start, end int) {
+			defer wg.Done()
+			for i := start; i < end; i++ {
+				c, d := NearestCentroid(centroids, points[i])
+				if c != assign[i] {
+					changed[w]++
+				}
+				assign[i], dists[i] = c, d
+			}
+		}(w, start, end)
+	}
+	wg.Wait()
+
+	total := 0
+	for _, n := range changed {
+		total += n
+	}
+	return total
+}
+
+// NearestCentroid returns the index of the centroid closest to p by squared L2 distance, and that distance
+func NearestCentroid(centroids [][]float32, p []float32) (int, float32) {
+	best, bestDist := 0, float32(math.Inf(1))
+	for c, centroid := range centroids {
+		if d := squaredL2(p, centroid); d < bestDist {
+			best, bestDist = c, d
+		}
+	}
+	return best, bestDist
+}
+
+func squaredL2(a, b []float32) float32 {
+	s := float32(0)
+	for i := range a {
+		d := a[i] - b[i]
+		s += d * d
+	}
+	return s
+}
@@ -0,0 +1,183 @@
+package bins
+
+import (
+	"fmt"
+
+	"github.com/dkblackley/bm25-bins-go/pianopir"
+)
+
+// PIRBatchSize is the batch size every SimpleBatchPianoPIR is set up with
+const PIRBatchSize = 32
+
+// PIRPartitions is how many partitions of consecutive entries SimpleBatchPianoPIR cuts a DB into. A batch only makes
+// len(batch)/PIRPartitions+1 queries to each partition and the rest of the entries asked of it come back as zeros, so
+// the entries one query wants shouldn't pile up in a partition.
+const PIRPartitions = PIRBatchSize / pianopir.RealQueryPerPartition
+
+// PIREntries is how many entries a PIR DB of n entries is padded to: a whole number of PIRPartitions partitions of
+// at least pianopir.MinPartitionSize entries. NewSimpleBatchPianoPIR panics on a DB that leaves its last partitions
+// empty, and partitions that are too small can't answer anything.
+func PIREntries(n int) int {
+	size := max((n+PIRPartitions-1)/PIRPartitions, int(pianopir.MinPartitionSize()))
+	return PIRPartitions * size
+}
+
+// MinPIREntries is the fewest entries a PIR DB has, see PIREntries
+var MinPIREntries = PIREntries(0)
+
+// RowLayout is how bins are laid out over fixed size PIR rows of RowSize docs: bin b is the run of rows
+// [Start[b], Start[b+1]). Padding every bin to the largest one wastes most of the DB, with runs the DB tracks the
+// real number of postings. Every bin gets at least one row, so an empty bin is fetched like any other. The layout only
+// depends on the bin sizes, so the client builds the same table from the bins artifact.
+//
+// Rows are numbered in run order, Entry says which PIR entry a row is in. A run of rows in consecutive entries would
+// all be in one Piano partition, which answers one or two of them a batch, so Stripe deals the rows out over the
+// partitions instead.
+type RowLayout struct {
+	RowSize int
+	Start   []uint64
+
+	PartitionSize int // entries in each of the PIRPartitions partitions, 0 until Stripe
+	maxRun        int
+}
+
+// NewRowLayout lays out bins of the given sizes over rows of rowSize docs
+func NewRowLayout(sizes []int, rowSize int) (RowLayout, error) {
+	if rowSize <= 0 {
+		return RowLayout{}, fmt.Errorf("NewRowLayout: row size %d", rowSize)
+	}
+	l := RowLayout{RowSize: rowSize, Start: make([]uint64, len(sizes)+1)}
+	for b, n := range sizes {
+		rows := max(1, (n+rowSize-1)/rowSize)
+		l.Start[b+1] = l.Start[b] + uint64(rows)
+		l.maxRun = max(l.maxRun, rows)
+	}
+	return l, nil
+}
+
+// Stripe puts row r in partition r%PIRPartitions of a PIR DB of PIREntries(NumRows) entries, so the rows of a run are
+// in consecutive partitions and a bin costs each partition at most ceil(run/PIRPartitions) queries. The entries past
+// the last row are empty.
+func (l RowLayout) Stripe() RowLayout {
+	l.PartitionSize = PIREntries(l.NumRows()) / PIRPartitions
+	return l
+}
+
+// RowLayout lays out the artifact's bins over rows of rowSize docs
+func (a *BinsArtifact) RowLayout(rowSize int) (RowLayout, error) {
+	sizes := make([]int, len(a.Bins))
+	for b, bin := range a.Bins {
+		sizes[b] = len(bin)
+	}
+	return NewRowLayout(sizes, rowSize)
+}
+
+// AutoRowSize is the mean size of the non-empty bins, rounded up, so a typical bin is one or two rows
+func AutoRowSize(a *BinsArtifact) int {
+	postings, nonEmpty := 0, 0
+	for _, bin := range a.Bins {
+		if len(bin) > 0 {
+			postings += len(bin)
+			nonEmpty++
+		}
+	}
+	if nonEmpty == 0 {
+		return 1
+	}
+	return (postings + nonEmpty - 1) / nonEmpty
+}
+
+// Bins is the number of bins in the layout
+func (l RowLayout) Bins() int {
+	return len(l.Start) - 1
+}
+
+// NumRows is the number of PIR rows, i.e. entries in the PIR DB
+func (l RowLayout) NumRows() int {
+	return int(l.Start[len(l.Start)-1])
+}
+
+// MaxRun is the most rows any bin spans
+func (l RowLayout) MaxRun() int {
+	return l.maxRun
+}
+
+// Entries is the number of entries in the PIR DB, the rows plus the padding Stripe adds
+func (l RowLayout) Entries() int {
+	if l.PartitionSize == 0 {
+		return l.NumRows()
+	}
+	return PIRPartitions * l.PartitionSize
+}
+
+// Entry is the PIR entry row is in, rows past NumRows are the padding entries
+func (l RowLayout) Entry(row uint64) uint64 {
+	if l.PartitionSize == 0 {
+		return row
+	}
+	return row%PIRPartitions*uint64(l.PartitionSize) + row/PIRPartitions
+}
+
+// Rows is the PIR entries bin is stored in, in order
+func (l RowLayout) Rows(bin uint64) []uint64 {
+	rows := make([]uint64, 0, l.Start[bin+1]-l.Start[bin])
+	for r := l.Start[bin]; r < l.Start[bin+1]; r++ {
+		rows = append(rows, l.Entry(r))
+	}
+	return rows
+}
+
+// Fetch is the PIR entries to query for bin: its Rows, then the rows after its run up to MaxRun, so every bin costs
+// the same number of queries and the server can't tell how big the bins a query wants are. The extra rows carry on
+// through the partitions (wrapping around at the end of the DB), so a fetch is spread evenly over the partitions.
+func (l RowLayout) Fetch(bin uint64) []uint64 {
+	entries := uint64(l.Entries())
+	fetch := make([]uint64, l.maxRun)
+	for j := range fetch {
+		fetch[j] = l.Entry((l.Start[bin] + uint64(j)) % entries)
+	}
+	return fetch
+}
+
+// SplitRows cuts the bins of DB into the docs of each PIR entry, in entry order. Padding entries are nil.
+func (l RowLayout) SplitRows(DB [][]uint32) ([][]uint32, error) {
+	if len(DB) != l.Bins() {
+		return nil, fmt.Errorf("SplitRows: %d bins but the layout has %d", len(DB), l.Bins())
+	}
+	rows := make([][]uint32, l.Entries())
+	for b, bin := range DB {
+		for r := l.Start[b]; r < l.Start[b+1]; r++ {
+			from := int(r-l.Start[b]) * l.RowSize
+			rows[l.Entry(r)] = bin[min(from, len(bin)):min(from+l.RowSize, len(bin))]
+		}
+	}
+	return rows, nil
+}
+
+// FetchBins privately fetches each of the bins in one batch with query (SimpleBatchPianoPIR.Query) and returns each
+// bin's rows back to back, plus how many of the rows Piano dropped. Every bin is fetched as MaxRun rows (see Fetch).
+// Dropped rows come back as zeros, which decode as empty.
+func (l RowLayout) FetchBins(query func(idx []uint64) ([][]uint64, error), bins []uint64) ([][]uint64, int, error) {
+	rows := make([]uint64, 0, len(bins)*l.maxRun)
+	for _, b := range bins {
+		rows = append(rows, l.Fetch(b)...)
+	}
+	responses, err := query(rows)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	answers := make([][]uint64, len(bins))
+	dropped := 0
+	for i, b := range bins {
+		run := int(l.Start[b+1] - l.Start[b])
+		for _, row := range responses[i*l.maxRun : i*l.maxRun+run] {
+			// every entry EntryCodec writes starts with a non-zero version
+			if row[0] == 0 {
+				dropped++
+			}
+			answers[i] = append(answers[i], row...)
+		}
+	}
+	return answers, dropped, nil
+}
@@ -0,0 +1,158 @@
+package bins
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"os"
+	"unsafe"
+)
+
+// Matrix is Rows x Dim float32s in one contiguous row-major slice. Row hands out views into it, so the 8.8M MS MARCO
+// vectors are one allocation (or one mapping of the file, see MapFloat32Matrix) rather than one per row.
+type Matrix struct {
+	Data []float32
+	Rows int
+	Dim  int
+
+	mapping []byte // set when Data is a memory-mapped file
+}
+
+// NewMatrix is a zeroed rows x dim matrix
+func NewMatrix(rows, dim int) *Matrix {
+	return &Matrix{Data: make([]float32, rows*dim), Rows: rows, Dim: dim}
+}
+
+// MatrixFromData wraps data, which has to hold rows x dim floats, without copying it
+func MatrixFromData(data []float32, rows, dim int) (*Matrix, error) {
+	if rows < 0 || dim < 0 || len(data) < rows*dim {
+		return nil, fmt.Errorf("MatrixFromData: %d floats for a %dx%d matrix", len(data), rows, dim)
+	}
+	return &Matrix{Data: data[:rows*dim], Rows: rows, Dim: dim}, nil
+}
+
+// MatrixFromRows copies rows, which all have to be the same length, into a Matrix
+func MatrixFromRows(rows [][]float32) (*Matrix, error) {
+	dim := 0
+	if len(rows) > 0 {
+		dim = len(rows[0])
+	}
+	m := NewMatrix(len(rows), dim)
+	for i, row := range rows {
+		if len(row) != dim {
+			return nil, fmt.Errorf("MatrixFromRows: row %d has %d columns, want %d", i, len(row), dim)
+		}
+		copy(m.Row(i), row)
+	}
+	return m, nil
+}
+
+// Row is a view of row i, writes to it go to the matrix. Its capacity ends with the row, so appending to it can't
+// overwrite the next one.
+func (m *Matrix) Row(i int) []float32 {
+	return m.Data[i*m.Dim : (i+1)*m.Dim : (i+1)*m.Dim]
+}
+
+// RowViews is a view of every row, for code that takes [][]float32. Only the slice headers are allocated, nil for a nil
+// matrix.
+func (m *Matrix) RowViews() [][]float32 {
+	if m == nil {
+		return nil
+	}
+	views := make([][]float32, m.Rows)
+	for i := range views {
+		views[i] = m.Row(i)
+	}
+	return views
+}
+
+// Slice is a view of rows [from, to)
+func (m *Matrix) Slice(from, to int) *Matrix {
+	return &Matrix{Data: m.Data[from*m.Dim : to*m.Dim], Rows: to - from, Dim: m.Dim}
+}
+
+// Checksum is the hex SHA-256 of the shape and the floats (little-endian), a chunk at a time so it never copies the
+// whole matrix
+func (m *Matrix) Checksum() string {
+	h := sha256.New()
+	var buf []byte
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(m.Rows))
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(m.Dim))
+	h.Write(buf)
+
+	const chunk = 1 << 16
+	buf = make([]byte, 4*chunk)
+	for start := 0; start < len(m.Data); start += chunk {
+		xs := m.Data[start:min(start+chunk, len(m.Data))]
+		for i, f := range xs {
+			binary.LittleEndian.PutUint32(buf[4*i:], math.Float32bits(f))
+		}
+		h.Write(buf[:4*len(xs)])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Close unmaps a memory-mapped matrix, after which none of its rows can be used. It does nothing for one on the heap.
+func (m *Matrix) Close() error {
+	if m == nil || m.mapping == nil {
+		return nil
+	}
+	err := unmap(m.mapping)
+	m.Data, m.mapping = nil, nil
+	return err
+}
+
+// MapFloat32Matrix memory-maps rows x dim little-endian float32s starting offset bytes into path. The rows are paged in
+// from the file as they're read, so only what's used counts against the process's memory, and writes to them stay in
+// memory. Close the matrix to unmap it. Where the floats can't be used in place (no mmap, a big-endian machine or an
+// unaligned offset) they're read into a matrix on the heap instead.
+func MapFloat32Matrix(path string, offset int64, rows, dim int) (*Matrix, error) {
+	raw, mapping, err := mapRange(path, offset, int64(rows)*int64(dim)*4)
+	if err != nil {
+		return nil, fmt.Errorf("MapFloat32Matrix: %w", err)
+	}
+	if mapping != nil && littleEndianHost() && uintptr(unsafe.Pointer(unsafe.SliceData(raw)))%4 == 0 {
+		data := unsafe.Slice((*float32)(unsafe.Pointer(unsafe.SliceData(raw))), rows*dim)
+		return &Matrix{Data: data, Rows: rows, Dim: dim, mapping: mapping}, nil
+	}
+
+	m := NewMatrix(rows, dim)
+	for i := range m.Data {
+		m.Data[i] = math.Float32frombits(binary.LittleEndian.Uint32(raw[i*4:]))
+	}
+	if mapping != nil {
+		unmap(mapping)
+	}
+	return m, nil
+}
+
+// mapRange maps size bytes of path from offset, see mapFile. mapping is nil if there is nothing to unmap.
+func mapRange(path string, offset, size int64) (raw []byte, mapping []byte, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	if offset < 0 || size < 0 || offset+size > info.Size() {
+		return nil, nil, fmt.Errorf("%s is %d bytes, too short for %d bytes at offset %d", path, info.Size(), size, offset)
+	}
+	if size == 0 {
+		return nil, nil, nil
+	}
+	raw, mapping, err = mapFile(f, offset, size)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return raw, mapping, nil
+}
+
+func littleEndianHost() bool {
+	probe := uint16(1)
+	return *(*byte)(unsafe.Pointer(&probe)) == 1
+}
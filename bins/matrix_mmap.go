@@ -0,0 +1,25 @@
+//go:build unix
+
+package bins
+
+import (
+	"os"
+	"syscall"
+)
+
+// mapFile maps size bytes of f from offset, copy-on-write so writes to it stay private. raw is the bytes asked for,
+// mapping what to unmap once they're no longer used.
+func mapFile(f *os.File, offset, size int64) (raw []byte, mapping []byte, err error) {
+	// mmap wants a page aligned offset, so map from the page the data starts in
+	page := int64(os.Getpagesize())
+	start := offset / page * page
+	mapping, err = syscall.Mmap(int(f.Fd()), start, int(offset-start+size), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_PRIVATE)
+	if err != nil {
+		return nil, nil, err
+	}
+	return mapping[offset-start:], mapping, nil
+}
+
+func unmap(mapping []byte) error {
+	return syscall.Munmap(mapping)
+}
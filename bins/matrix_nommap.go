@@ -0,0 +1,18 @@
+//go:build !unix
+
+package bins
+
+import "os"
+
+// mapFile reads the bytes into memory on platforms without mmap, so there's nothing to unmap
+func mapFile(f *os.File, offset, size int64) (raw []byte, mapping []byte, err error) {
+	raw = make([]byte, size)
+	if _, err := f.ReadAt(raw, offset); err != nil {
+		return nil, nil, err
+	}
+	return raw, nil, nil
+}
+
+func unmap(mapping []byte) error {
+	return nil
+}
@@ -0,0 +1,330 @@
+package bins
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMatrix(t *testing.T) {
+	rows := [][]float32{{1, 2, 3}, {4, 5, 6}, {7, 8, 9}}
+	m, err := MatrixFromRows(rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Rows != 3 || m.Dim != 3 || !reflect.DeepEqual(m.RowViews(), rows) {
+		t.Fatalf("MatrixFromRows = %dx%d %v; want %v", m.Rows, m.Dim, m.RowViews(), rows)
+	}
+
+	// Rows are views, and appending to one doesn't run into the next
+	m.Row(1)[0] = 40
+	if m.Data[3] != 40 {
+		t.Errorf("writing row 1 didn't reach the matrix")
+	}
+	_ = append(m.Row(0), 99)
+	if m.Data[3] != 40 {
+		t.Errorf("appending to row 0 overwrote row 1")
+	}
+	if s := m.Slice(1, 3); s.Rows != 2 || s.Row(1)[2] != 9 {
+		t.Errorf("Slice(1, 3) = %dx%d with row 1 %v", s.Rows, s.Dim, s.Row(1))
+	}
+	same, _ := MatrixFromRows(m.RowViews())
+	if same.Checksum() != m.Checksum() {
+		t.Errorf("a copy of the matrix has another checksum")
+	}
+	same.Row(2)[2] = 10
+	if same.Checksum() == m.Checksum() || m.Slice(0, 2).Checksum() == m.Checksum() {
+		t.Errorf("Checksum doesn't change with the floats or the shape")
+	}
+	if _, err := MatrixFromRows([][]float32{{1}, {1, 2}}); err == nil {
+		t.Errorf("MatrixFromRows accepted ragged rows")
+	}
+	if _, err := MatrixFromData(make([]float32, 5), 2, 3); err == nil {
+		t.Errorf("MatrixFromData accepted 5 floats for a 2x3 matrix")
+	}
+
+	path := filepath.Join(t.TempDir(), "vectors.npy")
+	if err := WriteFloat32Npy(path, rows); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadFloat32MatrixFromNpy(path, 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Rows != 2 || !reflect.DeepEqual(loaded.Row(1), []float32{4, 5, 6}) {
+		t.Errorf("LoadFloat32MatrixFromNpy = %dx%d with row 1 %v", loaded.Rows, loaded.Dim, loaded.Row(1))
+	}
+
+	// Raw float32s after a 12 byte header
+	raw := make([]byte, 12+6*4)
+	for i := 0; i < 6; i++ {
+		binary.LittleEndian.PutUint32(raw[12+i*4:], math.Float32bits(float32(i)))
+	}
+	rawPath := filepath.Join(t.TempDir(), "vectors.f32")
+	if err := os.WriteFile(rawPath, raw, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	mapped, err := MapFloat32Matrix(rawPath, 12, 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(mapped.Row(2), []float32{4, 5}) {
+		t.Errorf("mapped row 2 = %v; want [4 5]", mapped.Row(2))
+	}
+	if err := mapped.Close(); err != nil || mapped.Data != nil {
+		t.Errorf("Close = %v, data %v", err, mapped.Data)
+	}
+	if _, err := MapFloat32Matrix(rawPath, 12, 4, 2); err == nil {
+		t.Errorf("MapFloat32Matrix mapped past the end of the file")
+	}
+}
+
+// writeNpy writes a .npy by hand, so the parser isn't only tested against gonpy's output
+func writeNpy(t *testing.T, major byte, descr string, fortran bool, shape string, data []byte) string {
+	order := "False"
+	if fortran {
+		order = "True"
+	}
+	dict := fmt.Sprintf("{'descr': '%s', 'fortran_order': %s, 'shape': %s, }", descr, order, shape)
+	prefix := 10
+	if major == 2 {
+		prefix = 12
+	}
+	// numpy pads the header with spaces to a multiple of 64 and ends it with a newline
+	for (prefix+len(dict)+1)%64 != 0 {
+		dict += " "
+	}
+	dict += "\n"
+
+	header := []byte("\x93NUMPY")
+	header = append(header, major, 0)
+	if major == 2 {
+		header = binary.LittleEndian.AppendUint32(header, uint32(len(dict)))
+	} else {
+		header = binary.LittleEndian.AppendUint16(header, uint16(len(dict)))
+	}
+	path := filepath.Join(t.TempDir(), "m.npy")
+	if err := os.WriteFile(path, append(append(header, dict...), data...), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadNpyMatrix(t *testing.T) {
+	// The 3x2 matrix [[0 1] [2 3] [4 5]]
+	want := [][]float32{{0, 1}, {2, 3}, {4, 5}}
+	encode := func(order binary.AppendByteOrder, size int, fortran bool) []byte {
+		var data []byte
+		for k := 0; k < 6; k++ {
+			x := float64(k)
+			if fortran {
+				x = float64(k%3*2 + k/3)
+			}
+			switch size {
+			case 2:
+				data = order.AppendUint16(data, float32ToFloat16(float32(x)))
+			case 4:
+				data = order.AppendUint32(data, math.Float32bits(float32(x)))
+			case 8:
+				data = order.AppendUint64(data, math.Float64bits(x))
+			}
+		}
+		return data
+	}
+
+	for _, c := range []struct {
+		major   byte
+		descr   string
+		order   binary.AppendByteOrder
+		size    int
+		fortran bool
+	}{
+		{1, "<f4", binary.LittleEndian, 4, false},
+		{2, "<f4", binary.LittleEndian, 4, false},
+		{1, ">f4", binary.BigEndian, 4, false},
+		{1, "<f2", binary.LittleEndian, 2, false},
+		{1, "<f8", binary.LittleEndian, 8, false},
+		{2, ">f8", binary.BigEndian, 8, true},
+		{1, "<f4", binary.LittleEndian, 4, true},
+	} {
+		path := writeNpy(t, c.major, c.descr, c.fortran, "(3, 2)", encode(c.order, c.size, c.fortran))
+		h, err := ReadNpyHeader(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.Descr != c.descr || h.FortranOrder != c.fortran || !reflect.DeepEqual(h.Shape, []int{3, 2}) || h.DataOffset%64 != 0 {
+			t.Errorf("v%d %s: header %+v", c.major, c.descr, h)
+		}
+
+		m, err := LoadNpyMatrix(path, 0, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(m.RowViews(), want) {
+			t.Errorf("v%d %s fortran=%t: loaded %v; want %v", c.major, c.descr, c.fortran, m.RowViews(), want)
+		}
+		// Only the rows asked for
+		m, err = LoadNpyMatrix(path, 1, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(m.RowViews(), want[1:]) {
+			t.Errorf("v%d %s fortran=%t: rows [1, 3) = %v; want %v", c.major, c.descr, c.fortran, m.RowViews(), want[1:])
+		}
+		m.Close()
+	}
+
+	path := writeNpy(t, 1, "<f4", false, "(3, 2)", encode(binary.LittleEndian, 4, false))
+	if _, err := LoadNpyMatrix(path, 2, 4); err == nil {
+		t.Errorf("LoadNpyMatrix loaded rows past the end")
+	}
+	if _, err := LoadFloat32MatrixFromNpy(path, 4, 2); err == nil {
+		t.Errorf("LoadFloat32MatrixFromNpy loaded 4 rows from a 3 row file")
+	}
+	if _, err := LoadNpyMatrix(writeNpy(t, 1, "<i4", false, "(3, 2)", make([]byte, 24)), 0, -1); err == nil {
+		t.Errorf("LoadNpyMatrix loaded an int32 array")
+	}
+	if _, err := LoadNpyMatrix(writeNpy(t, 1, "<f4", false, "(6,)", make([]byte, 24)), 0, -1); err == nil {
+		t.Errorf("LoadNpyMatrix loaded a 1-d array")
+	}
+	if _, err := LoadNpyMatrix(writeNpy(t, 3, "<f4", false, "(3, 2)", make([]byte, 24)), 0, -1); err == nil {
+		t.Errorf("LoadNpyMatrix loaded a version 3.0 file")
+	}
+}
+
+func TestLoadVectors(t *testing.T) {
+	dir := t.TempDir()
+	want := [][]float32{{1, -2}, {3, 4}, {5, 6}}
+
+	var fvecs, ivecs, bvecs []byte
+	for _, row := range want {
+		fvecs = binary.LittleEndian.AppendUint32(fvecs, 2)
+		ivecs = binary.LittleEndian.AppendUint32(ivecs, 2)
+		bvecs = binary.LittleEndian.AppendUint32(bvecs, 2)
+		for _, x := range row {
+			fvecs = binary.LittleEndian.AppendUint32(fvecs, math.Float32bits(x))
+			ivecs = binary.LittleEndian.AppendUint32(ivecs, uint32(int32(x)))
+			bvecs = append(bvecs, byte(max(x, 0)))
+		}
+	}
+
+	// Two tensors so the name has to be given, vectors as F64 after an F32 one to check the data offsets
+	var tensors []byte
+	tensors = binary.LittleEndian.AppendUint32(tensors, math.Float32bits(7))
+	for _, row := range want {
+		for _, x := range row {
+			tensors = binary.LittleEndian.AppendUint64(tensors, math.Float64bits(float64(x)))
+		}
+	}
+	header := `{"__metadata__":{"format":"pt"},"bias":{"dtype":"F32","shape":[1],"data_offsets":[0,4]},` +
+		`"vectors":{"dtype":"F64","shape":[3,2],"data_offsets":[4,52]},"other":{"dtype":"F32","shape":[1,1],"data_offsets":[0,4]}}`
+	safetensors := binary.LittleEndian.AppendUint64(nil, uint64(len(header)))
+	safetensors = append(append(safetensors, header...), tensors...)
+
+	files := map[string][]byte{"v.fvecs": fvecs, "v.ivecs": ivecs, "v.bvecs": bvecs, "v.safetensors": safetensors}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, c := range []struct {
+		name string
+		n    int
+		want [][]float32
+	}{
+		{"v.fvecs", 0, want},
+		{"v.fvecs", 2, want[:2]},
+		{"v.ivecs", 0, want},
+		{"v.bvecs", 0, [][]float32{{1, 0}, {3, 4}, {5, 6}}},
+	} {
+		m, err := LoadVectors(filepath.Join(dir, c.name), c.n, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(m.RowViews(), c.want) {
+			t.Errorf("%s n=%d = %v; want %v", c.name, c.n, m.RowViews(), c.want)
+		}
+	}
+	if _, err := LoadVectors(filepath.Join(dir, "v.fvecs"), 0, 3); err == nil {
+		t.Errorf("loaded 2 dimension .fvecs as 3 dimensions")
+	}
+	if _, err := LoadVectors(filepath.Join(dir, "v.fvecs"), 4, 2); err == nil {
+		t.Errorf("loaded 4 vectors from a file of 3")
+	}
+
+	path := filepath.Join(dir, "v.safetensors")
+	if _, err := LoadVectors(path, 0, 2); err == nil {
+		t.Errorf("LoadVectors picked one of two 2-d safetensors tensors")
+	}
+	m, err := LoadSafetensors(path, "vectors", 2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m.RowViews(), want[:2]) {
+		t.Errorf("safetensors = %v; want %v", m.RowViews(), want[:2])
+	}
+	if _, err := LoadSafetensors(path, "vectors", 0, 3); err == nil {
+		t.Errorf("loaded a 2 column tensor as 3 columns")
+	}
+	if m, err := LoadSafetensors(path, "other", 0, 1); err != nil || m.Row(0)[0] != 7 {
+		t.Errorf("F32 tensor = %v, %v; want [[7]]", m, err)
+	}
+
+	if _, err := LoadVectors(filepath.Join(dir, "v.txt"), 0, 2); err == nil {
+		t.Errorf("LoadVectors loaded an unknown extension")
+	}
+}
+
+func TestDocRows(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vectors.npy.id")
+	if err := os.WriteFile(path, []byte("doc-b\ndoc-a\n 17 \nnot-loaded\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if VectorIDsPath("vectors.npy") != "vectors.npy.id" {
+		t.Errorf("VectorIDsPath = %s", VectorIDsPath("vectors.npy"))
+	}
+
+	d, err := LoadDocRows(path, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Len() != 3 || d.ID(1) != "doc-a" || !reflect.DeepEqual(d.IDs(), []string{"doc-b", "doc-a", "17"}) {
+		t.Errorf("Len, ID(1), IDs = %d, %s, %v", d.Len(), d.ID(1), d.IDs())
+	}
+	if row, ok := d.Row("17"); !ok || row != 2 {
+		t.Errorf("Row(17) = %d, %t; want 2", row, ok)
+	}
+	if _, ok := d.Row("not-loaded"); ok {
+		t.Errorf("found a row for an _id past the loaded vectors")
+	}
+	rows, err := d.Rows([]string{"doc-a", "17", "doc-b"})
+	if err != nil || !reflect.DeepEqual(rows, []uint32{1, 2, 0}) {
+		t.Errorf("Rows = %v, %v; want [1 2 0]", rows, err)
+	}
+	if _, err := d.Rows([]string{"doc-a", "missing"}); err == nil {
+		t.Errorf("Rows accepted an _id with no vector")
+	}
+
+	if _, err := LoadDocRows(path, 5); err == nil {
+		t.Errorf("LoadDocRows accepted 4 _ids for 5 vectors")
+	}
+	if _, err := NewDocRows([]string{"a", "b", "a"}); err == nil {
+		t.Errorf("NewDocRows accepted a duplicate _id")
+	}
+
+	// Without a sidecar row i is _id i
+	identity := IdentityDocRows(10)
+	if row, ok := identity.Row("7"); !ok || row != 7 || identity.ID(3) != "3" {
+		t.Errorf("identity Row(7), ID(3) = %d %t, %s", row, ok, identity.ID(3))
+	}
+	for _, id := range []string{"007", "10", "-1", "x"} {
+		if _, ok := identity.Row(id); ok {
+			t.Errorf("identity mapping has a row for %q", id)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package bins
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// The official MS MARCO files are TSV rather than BEIR JSONL: collection.tsv is pid<TAB>passage (the document
+// collection msmarco-docs.tsv is docid<TAB>url<TAB>title<TAB>body) and queries.*.tsv is qid<TAB>query. The loaders
+// sniff which one they've got, so either can be used without converting it first.
+
+// isJSONL says whether r holds JSON lines rather than TSV, going by its first non-space byte. It only peeks, so
+// nothing is consumed.
+func isJSONL(r *bufio.Reader) bool {
+	head, _ := r.Peek(4096)
+	head = bytes.TrimLeft(head, " \t\r\n\ufeff")
+	return len(head) > 0 && head[0] == '{'
+}
+
+// parseCollectionLine reads one line of an MS MARCO collection
+func parseCollectionLine(line string) (beirDoc, error) {
+	fields := strings.Split(strings.TrimRight(line, "\r"), "\t")
+	switch len(fields) {
+	case 2:
+		return beirDoc{ID: fields[0], Text: fields[1]}, nil
+	case 3:
+		return beirDoc{ID: fields[0], Title: fields[1], Text: fields[2]}, nil
+	case 4:
+		return beirDoc{ID: fields[0], Title: fields[2], Text: fields[3]}, nil
+	}
+	return beirDoc{}, fmt.Errorf("collection line has %d tab-separated fields, want id and passage (or id, url, title and body)", len(fields))
+}
+
+// parseQueryLine reads one line of an MS MARCO queries file
+func parseQueryLine(line string) (Query, error) {
+	id, text, ok := strings.Cut(strings.TrimRight(line, "\r"), "\t")
+	if !ok {
+		return Query{}, fmt.Errorf("query line %q has no tab between the id and the query", line)
+	}
+	return Query{ID: id, Text: text}, nil
+}
@@ -0,0 +1,216 @@
+package bins
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const npyMagic = "\x93NUMPY"
+
+// NpyHeader is the header of a version 1.0 or 2.0 .npy file
+type NpyHeader struct {
+	Major, Minor int
+	Descr        string // numpy dtype string, e.g. <f4
+	FortranOrder bool
+	Shape        []int
+	DataOffset   int64 // where the array starts in the file
+}
+
+// ReadNpyHeader reads the header of the .npy at path, without reading any of the array
+func ReadNpyHeader(path string) (NpyHeader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return NpyHeader{}, err
+	}
+	defer f.Close()
+	h, err := readNpyHeader(f)
+	if err != nil {
+		return NpyHeader{}, fmt.Errorf("%s: %w", path, err)
+	}
+	return h, nil
+}
+
+func readNpyHeader(r io.Reader) (NpyHeader, error) {
+	var prefix [10]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return NpyHeader{}, fmt.Errorf("reading .npy header: %w", err)
+	}
+	if string(prefix[:6]) != npyMagic {
+		return NpyHeader{}, fmt.Errorf("not a .npy file")
+	}
+	h := NpyHeader{Major: int(prefix[6]), Minor: int(prefix[7])}
+
+	var length int
+	switch h.Major {
+	case 1:
+		length = int(binary.LittleEndian.Uint16(prefix[8:]))
+		h.DataOffset = 10 + int64(length)
+	case 2:
+		var rest [2]byte
+		if _, err := io.ReadFull(r, rest[:]); err != nil {
+			return NpyHeader{}, fmt.Errorf("reading .npy header: %w", err)
+		}
+		length = int(binary.LittleEndian.Uint32([]byte{prefix[8], prefix[9], rest[0], rest[1]}))
+		h.DataOffset = 12 + int64(length)
+	default:
+		return NpyHeader{}, fmt.Errorf(".npy version %d.%d, only 1.0 and 2.0 are supported", h.Major, h.Minor)
+	}
+
+	dict := make([]byte, length)
+	if _, err := io.ReadFull(r, dict); err != nil {
+		return NpyHeader{}, fmt.Errorf("reading .npy header: %w", err)
+	}
+	err := h.parseDict(strings.ReplaceAll(string(dict), `"`, `'`))
+	return h, err
+}
+
+// parseDict reads the header's python dict literal, e.g. {'descr': '<f4', 'fortran_order': False, 'shape': (3, 2), }
+func (h *NpyHeader) parseDict(dict string) error {
+	field := func(key string) (string, error) {
+		i := strings.Index(dict, "'"+key+"'")
+		if i < 0 {
+			return "", fmt.Errorf(".npy header %q has no %s", dict, key)
+		}
+		rest := strings.TrimSpace(dict[i+len(key)+2:])
+		rest = strings.TrimSpace(strings.TrimPrefix(rest, ":"))
+		var end int
+		switch {
+		case strings.HasPrefix(rest, "'"):
+			rest = rest[1:]
+			end = strings.IndexByte(rest, '\'')
+		case strings.HasPrefix(rest, "("):
+			rest = rest[1:]
+			end = strings.IndexByte(rest, ')')
+		default:
+			end = strings.IndexAny(rest, ",}")
+		}
+		if end < 0 {
+			return "", fmt.Errorf(".npy header %q has a bad %s", dict, key)
+		}
+		return strings.TrimSpace(rest[:end]), nil
+	}
+
+	var err error
+	if h.Descr, err = field("descr"); err != nil {
+		return err
+	}
+	order, err := field("fortran_order")
+	if err != nil {
+		return err
+	}
+	switch order {
+	case "True":
+		h.FortranOrder = true
+	case "False":
+	default:
+		return fmt.Errorf(".npy header has fortran_order %q", order)
+	}
+	shape, err := field("shape")
+	if err != nil {
+		return err
+	}
+	h.Shape = nil
+	for _, s := range strings.Split(shape, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return fmt.Errorf(".npy header has shape (%s)", shape)
+		}
+		h.Shape = append(h.Shape, n)
+	}
+	return nil
+}
+
+// dtype is the byte order and size of a float Descr
+func (h NpyHeader) dtype() (binary.ByteOrder, int, error) {
+	if len(h.Descr) != 3 || h.Descr[1] != 'f' {
+		return nil, 0, fmt.Errorf("dtype %s, want float16, float32 or float64", h.Descr)
+	}
+	var order binary.ByteOrder
+	switch h.Descr[0] {
+	case '<', '|':
+		order = binary.LittleEndian
+	case '>':
+		order = binary.BigEndian
+	case '=':
+		order = binary.LittleEndian
+		if !littleEndianHost() {
+			order = binary.BigEndian
+		}
+	default:
+		return nil, 0, fmt.Errorf("dtype %s has an unknown byte order", h.Descr)
+	}
+	switch size := int(h.Descr[2] - '0'); size {
+	case 2, 4, 8:
+		return order, size, nil
+	}
+	return nil, 0, fmt.Errorf("dtype %s, want float16, float32 or float64", h.Descr)
+}
+
+// LoadNpyMatrix loads rows [from, to) of a 2-d float16, float32 or float64 .npy in either order (to < 0 is up to the
+// last row). A little-endian float32 file in C order is memory-mapped as it is (see MapFloat32Matrix), anything else is
+// converted to float32 from a mapping of just the bytes the rows are in, so no more of the file is read than has to be.
+func LoadNpyMatrix(path string, from, to int) (*Matrix, error) {
+	h, err := ReadNpyHeader(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(h.Shape) != 2 {
+		return nil, fmt.Errorf("%s: want a 2-d array, got shape %v", path, h.Shape)
+	}
+	order, size, err := h.dtype()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	rows, dim := h.Shape[0], h.Shape[1]
+	if to < 0 {
+		to = rows
+	}
+	if from < 0 || from > to || to > rows {
+		return nil, fmt.Errorf("%s: rows [%d, %d) out of range, it has %d", path, from, to, rows)
+	}
+	n := to - from
+
+	if size == 4 && order == binary.LittleEndian && !h.FortranOrder {
+		return MapFloat32Matrix(path, h.DataOffset+int64(from)*int64(dim)*4, n, dim)
+	}
+
+	// at(i, j) is where element (from+i, j) is in raw
+	offset, length := h.DataOffset+int64(from)*int64(dim)*int64(size), int64(n)*int64(dim)*int64(size)
+	at := func(i, j int) int { return (i*dim + j) * size }
+	if h.FortranOrder {
+		offset, length = h.DataOffset, int64(rows)*int64(dim)*int64(size)
+		at = func(i, j int) int { return (j*rows + from + i) * size }
+	}
+	raw, mapping, err := mapRange(path, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	if mapping != nil {
+		defer unmap(mapping)
+	}
+
+	m := NewMatrix(n, dim)
+	for i := 0; i < n; i++ {
+		row := m.Row(i)
+		for j := range row {
+			b := raw[at(i, j):]
+			switch size {
+			case 2:
+				row[j] = float16ToFloat32(order.Uint16(b))
+			case 4:
+				row[j] = math.Float32frombits(order.Uint32(b))
+			case 8:
+				row[j] = float32(math.Float64frombits(order.Uint64(b)))
+			}
+		}
+	}
+	return m, nil
+}
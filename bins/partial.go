@@ -0,0 +1,222 @@
+package bins
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"sort"
+)
+
+// PartialBins are the bins built from the vocabulary terms [Start, End) of one shard. They are what a shard process
+// writes out for MergePartialBins, and also what a checkpoint holds while the shard is still being built (End is then
+// the next term to search). Config and Vocabulary are recorded so partials from different builds are never mixed.
+type PartialBins struct {
+	Config     Config
+	Vocabulary string // Vocabulary.Fingerprint of the vocabulary being binned
+	Terms      int    // Vocabulary.Len of the vocabulary being binned
+	Shard      uint
+	Shards     uint
+	Start      int
+	End        int
+	Bins       map[uint][]string
+
+	// BuildStats for the terms [Start, End)
+	Searched    uint64
+	Dropped     uint64
+	TermsPerBin map[uint]uint32
+}
+
+func (c Config) checkpointEvery() int {
+	if c.CheckpointEvery == 0 {
+		return DefaultCheckpointEvery
+	}
+	return int(c.CheckpointEvery)
+}
+
+// sameBins reports whether two configs produce the same bins, i.e. ignoring workers and checkpointing options
+func (c Config) sameBins(other Config) bool {
+	return c.K == other.K && c.D == other.D && c.MaxBins == other.MaxBins && c.Threshold == other.Threshold &&
+		c.Binning == other.Binning
+}
+
+// Fingerprint is a hex SHA-256 over the terms of the vocabulary, in order
+func (v *Vocabulary) Fingerprint() string {
+	h := sha256.New()
+	var buf [8]byte
+	for _, term := range v.Terms {
+		binary.LittleEndian.PutUint64(buf[:], uint64(len(term)))
+		h.Write(buf[:])
+		h.Write([]byte(term))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// ShardRange splits n vocabulary terms into shards contiguous ranges and returns the range [start, end) of shard.
+// The vocabulary is sorted, so every process computes the same split.
+func ShardRange(n int, shard, shards uint) (int, int) {
+	start := int(uint64(n) * uint64(shard) / uint64(shards))
+	end := int(uint64(n) * uint64(shard+1) / uint64(shards))
+	return start, end
+}
+
+func newPartialBins(vocab *Vocabulary, config Config, shard, shards uint, start, end int, b *binBuilder) *PartialBins {
+	p := &PartialBins{
+		Config:     config,
+		Vocabulary: vocab.Fingerprint(),
+		Terms:      vocab.Len(),
+		Shard:      shard,
+		Shards:     shards,
+		Start:      start,
+		End:        end,
+		Bins:       make(map[uint][]string, len(b.sets)),
+
+		Searched:    b.searched,
+		Dropped:     b.dropped,
+		TermsPerBin: maps.Clone(b.termsPerBin),
+	}
+	for bin, set := range b.sets {
+		docIDs := make([]string, 0, len(set))
+		for docID := range set {
+			docIDs = append(docIDs, docID)
+		}
+		sort.Strings(docIDs)
+		p.Bins[bin] = docIDs
+	}
+	return p
+}
+
+func (p *PartialBins) addTo(b *binBuilder) {
+	for bin, docIDs := range p.Bins {
+		for _, docID := range docIDs {
+			add(b.sets, bin, docID)
+		}
+	}
+	for bin, n := range p.TermsPerBin {
+		b.termsPerBin[bin] += n
+	}
+	b.searched += p.Searched
+	b.dropped += p.Dropped
+}
+
+// check makes sure p belongs to the same build as vocab and config
+func (p *PartialBins) check(vocab *Vocabulary, config Config) error {
+	if !p.Config.sameBins(config) {
+		return fmt.Errorf("built with %+v, not %+v", p.Config, config)
+	}
+	if p.Vocabulary != vocab.Fingerprint() || p.Terms != vocab.Len() {
+		return errors.New("built from a different vocabulary")
+	}
+	return nil
+}
+
+// WritePartialBins writes p to path. The file is written next to path and renamed over it, so a job killed mid-write
+// leaves the previous file intact.
+func WritePartialBins(path string, p *PartialBins) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := gob.NewEncoder(f).Encode(p); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func ReadPartialBins(path string) (*PartialBins, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var p PartialBins
+	if err := gob.NewDecoder(f).Decode(&p); err != nil {
+		return nil, fmt.Errorf("partial bins %s: %w", path, err)
+	}
+	return &p, nil
+}
+
+// loadCheckpoint reads the checkpoint of a shard, returning nil if there isn't one yet. A checkpoint from a different
+// vocabulary, Config or shard is an error rather than something to silently start over from.
+func loadCheckpoint(path string, vocab *Vocabulary, config Config, shard, shards uint) (*PartialBins, error) {
+	cp, err := ReadPartialBins(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cp.check(vocab, config); err != nil {
+		return nil, fmt.Errorf("checkpoint %s was %v. Delete it to start over", path, err)
+	}
+	start, end := ShardRange(vocab.Len(), shard, shards)
+	if cp.Shard != shard || cp.Shards != shards || cp.Start != start || cp.End < start || cp.End > end {
+		return nil, fmt.Errorf("checkpoint %s is for shard %d/%d terms [%d, %d), not shard %d/%d. Delete it to start over",
+			path, cp.Shard, cp.Shards, cp.Start, cp.End, shard, shards)
+	}
+
+	return cp, nil
+}
+
+// MergePartialBins combines the outputs of every shard of a build into the final bin table. All shards 0..Shards-1
+// must be present exactly once and agree on the Config and vocabulary, the result is then identical to a single
+// process build.
+func MergePartialBins(parts []*PartialBins) ([][]string, BuildStats, error) {
+	if len(parts) == 0 {
+		return nil, BuildStats{}, errors.New("MergePartialBins: nothing to merge")
+	}
+
+	first := parts[0]
+	seen := make([]bool, first.Shards)
+	builder := newBinBuilder()
+	for _, p := range parts {
+		if !p.Config.sameBins(first.Config) || p.Vocabulary != first.Vocabulary || p.Terms != first.Terms ||
+			p.Shards != first.Shards {
+			return nil, BuildStats{}, fmt.Errorf("MergePartialBins: shard %d/%d doesn't belong to the same build as shard %d/%d",
+				p.Shard, p.Shards, first.Shard, first.Shards)
+		}
+		if p.Shard >= p.Shards {
+			return nil, BuildStats{}, fmt.Errorf("MergePartialBins: shard %d out of range [0, %d)", p.Shard, p.Shards)
+		}
+		if start, end := ShardRange(p.Terms, p.Shard, p.Shards); p.Start != start || p.End != end {
+			return nil, BuildStats{}, fmt.Errorf("MergePartialBins: shard %d/%d only covers terms [%d, %d) of [%d, %d), is it a checkpoint?",
+				p.Shard, p.Shards, p.Start, p.End, start, end)
+		}
+		if seen[p.Shard] {
+			return nil, BuildStats{}, fmt.Errorf("MergePartialBins: shard %d given twice", p.Shard)
+		}
+		seen[p.Shard] = true
+		p.addTo(builder)
+	}
+	for shard, ok := range seen {
+		if !ok {
+			return nil, BuildStats{}, fmt.Errorf("MergePartialBins: shard %d/%d is missing", shard, first.Shards)
+		}
+	}
+
+	stats := BuildStats{
+		Searched:    builder.searched,
+		Dropped:     builder.dropped,
+		TermsPerBin: make([]uint32, first.Config.MaxBins),
+	}
+	for bin, n := range builder.termsPerBin {
+		stats.TermsPerBin[bin] = n
+	}
+
+	return builder.sets.toSlice(first.Config.MaxBins), stats, nil
+}
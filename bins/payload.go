@@ -0,0 +1,33 @@
+package bins
+
+import "fmt"
+
+// Payload is what a PIR entry holds for each doc in its bin
+type Payload int
+
+const (
+	PayloadVectors Payload = iota // the doc's index and its encoded vector, see EntryCodec
+	PayloadDocIDs                 // just the doc's index into the bins artifact doc dictionary, DocIDBytes bytes
+)
+
+// DocIDBytes is the size of a doc index in an entry
+const DocIDBytes = 4
+
+// Payload is PayloadDocIDs when Config.Filenames is set. It only changes how the bins are encoded for PIR, not the
+// bins themselves, so the same artifact serves both.
+func (c Config) Payload() Payload {
+	if c.Filenames {
+		return PayloadDocIDs
+	}
+	return PayloadVectors
+}
+
+func (p Payload) String() string {
+	switch p {
+	case PayloadVectors:
+		return "vectors"
+	case PayloadDocIDs:
+		return "ids"
+	}
+	return fmt.Sprintf("Payload(%d)", int(p))
+}
@@ -0,0 +1,164 @@
+package bins
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/dkblackley/bm25-bins-go/pianopir"
+)
+
+var (
+	DefaultPlanKs          = []uint{10, 20, 50, 100, 200}
+	DefaultPlanBinDivisors = []uint{10, 20, 50, 100, 200, 500, 1000}
+)
+
+// PlanTarget is what PlanConfigs has to fit the bins into. Leave a limit at 0 to not constrain it.
+type PlanTarget struct {
+	DBBytes     uint64 // largest acceptable rawDB, in bytes
+	ClientBytes uint64 // largest acceptable client storage for the Piano hints, in bytes
+	BytesPerDoc int    // bytes a document takes up in a PIR entry, DocIDBytes+DIM*4 for float32 vectors
+
+	D           uint
+	Ks          []uint // candidate K values, DefaultPlanKs if empty
+	BinDivisors []uint // candidate MaxBins as NumDocs / divisor, DefaultPlanBinDivisors if empty
+
+	BatchSize       uint64 // as passed to NewSimpleBatchPianoPIR
+	FailureProbLog2 uint64
+}
+
+// Plan is one candidate Config along with what building it is expected to cost
+type Plan struct {
+	Config     Config
+	KeptTerms  uint64 // terms with more than Threshold hits
+	Postings   uint64 // docs placed into bins, counting a doc again for every colliding term that holds it
+	MaxRowSize int    // the largest bin
+	RowSize    int    // docs per PIR row, the mean non-empty bin as in AutoRowSize
+	Rows       uint64 // PIR rows once every bin is a run of rows, see RowLayout
+	EntryBytes uint64 // entry header and RowSize docs, rounded up to the 32 byte multiple Piano needs
+	RawDBBytes uint64
+	Costs      pianopir.BatchPIRCosts
+	Fits       bool
+}
+
+// PlanConfigs estimates every combination of the candidate K and MaxBins values against the vocabulary statistics,
+// without running a single search. Threshold is K/10 as in main. A term is assumed to get min(K, DocFreq) hits, and
+// since hashTokenChoice doesn't depend on the search, the bins each term lands in (and so the largest bin) are worked
+// out exactly. The only thing left over is docs shared by colliding terms, so MaxRowSize is an upper bound, and the
+// row layout (and so the sizes that follow from it) is what the bins would get at those loads.
+//
+// The plans are returned best first: plans that fit the target with the largest K, then the smallest rawDB.
+func PlanConfigs(vocab *Vocabulary, target PlanTarget) []Plan {
+	ks := target.Ks
+	if len(ks) == 0 {
+		ks = DefaultPlanKs
+	}
+	divisors := target.BinDivisors
+	if len(divisors) == 0 {
+		divisors = DefaultPlanBinDivisors
+	}
+
+	// hashes[t*(D+1)+d] is hashTokenChoice(term t, choice d), the only expensive part
+	choices := int(target.D) + 1
+	hashes := make([]uint64, vocab.Len()*choices)
+	for t, term := range vocab.Terms {
+		for d := 0; d < choices; d++ {
+			hashes[t*choices+d] = hashTokenChoice(term, uint(d))
+		}
+	}
+
+	var plans []Plan
+	for _, k := range ks {
+		for _, divisor := range divisors {
+			maxBins := uint(vocab.NumDocs) / divisor
+			if maxBins == 0 {
+				continue
+			}
+			config := Config{K: k, D: target.D, MaxBins: maxBins, Threshold: k / 10}
+			plans = append(plans, planConfig(vocab, hashes, config, target))
+		}
+	}
+
+	sort.SliceStable(plans, func(i, j int) bool {
+		a, b := plans[i], plans[j]
+		if a.Fits != b.Fits {
+			return a.Fits
+		}
+		if a.Fits && a.Config.K != b.Config.K {
+			return a.Config.K > b.Config.K
+		}
+		return a.RawDBBytes < b.RawDBBytes
+	})
+
+	return plans
+}
+
+func planConfig(vocab *Vocabulary, hashes []uint64, config Config, target PlanTarget) Plan {
+	choices := int(config.D) + 1
+	loads := make([]uint64, config.MaxBins)
+	plan := Plan{Config: config}
+
+	bins := make([]uint, 0, choices)
+	for t, df := range vocab.DocFreq {
+		hits := min(uint64(df), uint64(config.K))
+		if hits <= uint64(config.Threshold) {
+			continue
+		}
+		plan.KeptTerms++
+
+		// as in binTerm, a term landing in the same bin twice only fills it once
+		bins = bins[:0]
+		for d := 0; d < choices; d++ {
+			bin := uint(hashes[t*choices+d]) % config.MaxBins
+			if !slices.Contains(bins, bin) {
+				bins = append(bins, bin)
+				loads[bin] += hits
+				plan.Postings += hits
+			}
+		}
+	}
+
+	sizes := make([]int, len(loads))
+	postings, nonEmpty := 0, 0
+	for b, load := range loads {
+		sizes[b] = int(min(load, vocab.NumDocs))
+		plan.MaxRowSize = max(plan.MaxRowSize, sizes[b])
+		if sizes[b] > 0 {
+			postings += sizes[b]
+			nonEmpty++
+		}
+	}
+	plan.RowSize = 1
+	if nonEmpty > 0 {
+		plan.RowSize = (postings + nonEmpty - 1) / nonEmpty
+	}
+	for _, n := range sizes { // as in NewRowLayout
+		plan.Rows += uint64(max(1, (n+plan.RowSize-1)/plan.RowSize))
+	}
+
+	plan.EntryBytes = uint64(EntryBytes(plan.RowSize, target.BytesPerDoc))
+	plan.RawDBBytes = plan.Rows * plan.EntryBytes
+	if plan.Rows > 0 {
+		plan.Costs = pianopir.EstimateSimpleBatchPianoPIR(plan.Rows, plan.EntryBytes, target.BatchSize, target.FailureProbLog2)
+	}
+
+	plan.Fits = (target.DBBytes == 0 || plan.RawDBBytes <= target.DBBytes) &&
+		(target.ClientBytes == 0 || uint64(plan.Costs.LocalStorage) <= target.ClientBytes)
+
+	return plan
+}
+
+// PrintPlans writes the plans as a table, in the units SimpleBatchPianoPIR.PrintInfo uses
+func PrintPlans(w io.Writer, plans []Plan) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "fits\tK\tD\tMaxBins\tThreshold\tkept terms\tmax_row_size\trow size\trows\tentry bytes\trawDB MB\tclient MB\tmax query num\tonline KB/batch\tamortized prep KB/batch\t")
+	for _, p := range plans {
+		fmt.Fprintf(tw, "%t\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%.1f\t%.1f\t%d\t%d\t%.1f\t\n",
+			p.Fits, p.Config.K, p.Config.D, p.Config.MaxBins, p.Config.Threshold, p.KeptTerms, p.MaxRowSize,
+			p.RowSize, p.Rows, p.EntryBytes, float64(p.RawDBBytes)/1024/1024, p.Costs.LocalStorage/1024/1024, p.Costs.MaxQueryNum,
+			p.Costs.CommCostPerBatchOnline/1024, p.Costs.AmortizedPrepCommPerBatch/1024)
+	}
+	return tw.Flush()
+}
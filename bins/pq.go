@@ -0,0 +1,166 @@
+package bins
+
+import (
+	"encoding/gob"
+	"fmt"
+	"math/rand"
+	"os"
+)
+
+// MaxPQCentroids is the most centroids a subspace can have, each code is one byte
+const MaxPQCentroids = 256
+
+// PQCodebook is a product quantizer: vectors are split into Subspaces equal slices and each slice is replaced by the
+// index of its nearest centroid, so a doc takes Subspaces bytes. The client needs the codebook to score the codes.
+type PQCodebook struct {
+	Dim       int
+	Subspaces int
+	Centroids [][][]float32 // [subspace][centroid] -> Dim/Subspaces floats
+}
+
+// TrainPQ trains a codebook with k-means in each subspace over a seeded sample of up to sample vectors
+func TrainPQ(vectors [][]float32, dim, subspaces, centroids, sample, iters int, seed int64) (*PQCodebook, error) {
+	if subspaces <= 0 || dim%subspaces != 0 {
+		return nil, fmt.Errorf("TrainPQ: %d dims don't split into %d subspaces", dim, subspaces)
+	}
+	if centroids <= 0 || centroids > MaxPQCentroids {
+		return nil, fmt.Errorf("TrainPQ: %d centroids per subspace, want 1 to %d", centroids, MaxPQCentroids)
+	}
+	if len(vectors) == 0 {
+		return nil, fmt.Errorf("TrainPQ: no vectors to train on")
+	}
+
+	rng := rand.New(rand.NewSource(seed))
+	train := vectors
+	if sample > 0 && sample < len(vectors) {
+		train = make([][]float32, sample)
+		for i, j := range rng.Perm(len(vectors))[:sample] {
+			train[i] = vectors[j]
+		}
+	}
+
+	sub := dim / subspaces
+	c := &PQCodebook{Dim: dim, Subspaces: subspaces, Centroids: make([][][]float32, subspaces)}
+	for s := 0; s < subspaces; s++ {
+		points := make([][]float32, len(train))
+		for i, v := range train {
+			points[i] = v[s*sub : (s+1)*sub]
+		}
+		c.Centroids[s] = KMeans(points, centroids, iters, seed+int64(s))
+	}
+	return c, nil
+}
+
+func (c *PQCodebook) subDim() int {
+	return c.Dim / c.Subspaces
+}
+
+// Encode writes the Subspaces byte code of v into dst
+func (c *PQCodebook) Encode(dst []byte, v []float32) {
+	sub := c.subDim()
+	for s := 0; s < c.Subspaces; s++ {
+		nearest, _ := NearestCentroid(c.Centroids[s], v[s*sub:(s+1)*sub])
+		dst[s] = byte(nearest)
+	}
+}
+
+// Decode reconstructs a vector from its code, i.e. the concatenated centroids. The code has to pass checkCode.
+func (c *PQCodebook) Decode(dst []float32, code []byte) {
+	sub := c.subDim()
+	for s := 0; s < c.Subspaces; s++ {
+		copy(dst[s*sub:(s+1)*sub], c.Centroids[s][code[s]])
+	}
+}
+
+// checkCode makes sure every byte of code is a centroid of its subspace, so a garbled PIR answer (or entries encoded
+// with a bigger codebook) is an error rather than an index out of range
+func (c *PQCodebook) checkCode(code []byte) error {
+	if len(code) < c.Subspaces {
+		return fmt.Errorf("pq code has %d bytes, want %d", len(code), c.Subspaces)
+	}
+	for s := 0; s < c.Subspaces; s++ {
+		if int(code[s]) >= len(c.Centroids[s]) {
+			return fmt.Errorf("pq code %d in subspace %d, the codebook has %d centroids", code[s], s, len(c.Centroids[s]))
+		}
+	}
+	return nil
+}
+
+// DotTable is the asymmetric distance table for query: the dot product of each subspace of the (unquantized) query with
+// every centroid of that subspace. ADC then scores a code with Subspaces lookups instead of decoding it.
+func (c *PQCodebook) DotTable(query []float32) [][]float32 {
+	sub := c.subDim()
+	table := make([][]float32, c.Subspaces)
+	for s := range table {
+		q := query[s*sub : (s+1)*sub]
+		table[s] = make([]float32, len(c.Centroids[s]))
+		for k, centroid := range c.Centroids[s] {
+			for j := range q {
+				table[s][k] += q[j] * centroid[j]
+			}
+		}
+	}
+	return table
+}
+
+// ADC is the dot product of the query DotTable was built for with the vector code encodes, which has to pass checkCode
+func ADC(table [][]float32, code []byte) float64 {
+	score := 0.0
+	for s, row := range table {
+		score += float64(row[code[s]])
+	}
+	return score
+}
+
+// Checksum identifies the codebook, so the bins artifact can make sure the client has the one the entries were
+// encoded with
+func (c *PQCodebook) Checksum() string {
+	flat := make([]float32, 0, c.Dim*MaxPQCentroids+2)
+	flat = append(flat, float32(c.Dim), float32(c.Subspaces))
+	for _, centroids := range c.Centroids {
+		for _, centroid := range centroids {
+			flat = append(flat, centroid...)
+		}
+	}
+	return HashFloat32s(flat)
+}
+
+func (c *PQCodebook) check() error {
+	if c.Subspaces <= 0 || c.Dim%c.Subspaces != 0 || len(c.Centroids) != c.Subspaces {
+		return fmt.Errorf("codebook has %d subspaces over %d dims", len(c.Centroids), c.Dim)
+	}
+	for s, centroids := range c.Centroids {
+		if len(centroids) == 0 || len(centroids) > MaxPQCentroids {
+			return fmt.Errorf("codebook subspace %d has %d centroids", s, len(centroids))
+		}
+		for _, centroid := range centroids {
+			if len(centroid) != c.subDim() {
+				return fmt.Errorf("codebook subspace %d has a centroid of %d dims, want %d", s, len(centroid), c.subDim())
+			}
+		}
+	}
+	return nil
+}
+
+func WritePQCodebook(path string, c *PQCodebook) error {
+	return writeFileAtomic(path, func(f *os.File) error {
+		return gob.NewEncoder(f).Encode(c)
+	})
+}
+
+func ReadPQCodebook(path string) (*PQCodebook, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var c PQCodebook
+	if err := gob.NewDecoder(f).Decode(&c); err != nil {
+		return nil, fmt.Errorf("codebook %s: %w", path, err)
+	}
+	if err := c.check(); err != nil {
+		return nil, fmt.Errorf("codebook %s: %w", path, err)
+	}
+	return &c, nil
+}
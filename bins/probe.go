@@ -0,0 +1,81 @@
+package bins
+
+import "fmt"
+
+// ProbeSource is a (token, hash choice) pair that hashed to a probed bin
+type ProbeSource struct {
+	Token  int // position in the query's tokens
+	Choice uint
+}
+
+// ProbePlan is the lexical bins a query fetches: every token's bin under each of Choices, the same bins binTerm put
+// the token's top-K docs into, with duplicates dropped so no PIR query is wasted on them. Sources[i] lists the
+// (token, choice) pairs that hashed to Indices[i].
+type ProbePlan struct {
+	Tokens  int
+	Choices []uint
+	Indices []uint64
+	Sources [][]ProbeSource
+}
+
+// PlanProbes hashes tokens to their bins under each of choices, out of maxBins bins
+func PlanProbes(tokens []string, choices []uint, maxBins uint) ProbePlan {
+	plan := ProbePlan{Tokens: len(tokens), Choices: choices}
+	pos := make(map[uint64]int, len(tokens)*len(choices))
+	for t, token := range tokens {
+		for _, c := range choices {
+			index := hashTokenChoice(token, c) % uint64(maxBins)
+			i, ok := pos[index]
+			if !ok {
+				i = len(plan.Indices)
+				pos[index] = i
+				plan.Indices = append(plan.Indices, index)
+				plan.Sources = append(plan.Sources, nil)
+			}
+			plan.Sources[i] = append(plan.Sources[i], ProbeSource{Token: t, Choice: c})
+		}
+	}
+	return plan
+}
+
+// BinWeights turns per-token weights (term IDFs, nil for all 1) into Retrieved.Weights for the probed bins. Each token's
+// weight is split evenly over its choices, so under RerankBM25 a doc scores weight[t] times the fraction of t's choice
+// bins it turned up in. A doc really in t's top-K is in all of them, while one that only collided with t in a single
+// bin gets a fraction.
+func (p ProbePlan) BinWeights(tokenWeights []float64) []float64 {
+	weights := make([]float64, len(p.Indices))
+	share := 1 / float64(max(len(p.Choices), 1))
+	for i, sources := range p.Sources {
+		for _, s := range sources {
+			w := 1.0
+			if tokenWeights != nil {
+				w = tokenWeights[s.Token]
+			}
+			weights[i] += w * share
+		}
+	}
+	return weights
+}
+
+// QueryChoices is the hash choices to probe: all of 0..D when choices is empty, otherwise choices, which have to be
+// ones the bins were built with
+func QueryChoices(choices []uint, config Config) ([]uint, error) {
+	if len(choices) == 0 {
+		all := make([]uint, config.D+1)
+		for d := range all {
+			all[d] = uint(d)
+		}
+		return all, nil
+	}
+	seen := make(map[uint]bool, len(choices))
+	for _, c := range choices {
+		if c > config.D {
+			return nil, fmt.Errorf("hash choice %d out of range, the bins were built with D=%d (choices 0..%d)", c, config.D, config.D)
+		}
+		if seen[c] {
+			return nil, fmt.Errorf("hash choice %d given twice", c)
+		}
+		seen[c] = true
+	}
+	return choices, nil
+}
@@ -0,0 +1,140 @@
+package bins
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+)
+
+// Projection maps a query into the doc vector space, so the client can score the vectors it decodes against it. Row i
+// of Matrix is where Terms[i] goes, e.g. the term embeddings the doc vectors were summed from, or the components of a
+// PCA/SVD of the term-doc matrix, and a query is the IDF-weighted sum of the rows of its tokens.
+type Projection struct {
+	Terms  []string
+	Matrix [][]float32
+	rows   map[string]int
+}
+
+// NewProjection pairs terms with the rows of matrix. A dimension x vocabulary matrix (how SVD components usually come
+// out) is transposed.
+func NewProjection(terms []string, matrix [][]float32) (*Projection, error) {
+	if len(matrix) != len(terms) {
+		if len(matrix) == 0 || len(matrix[0]) != len(terms) {
+			return nil, fmt.Errorf("NewProjection: %d terms but the matrix is %dx%d", len(terms), len(matrix), len(firstRow(matrix)))
+		}
+		matrix = transpose(matrix)
+	}
+
+	p := &Projection{Terms: terms, Matrix: matrix, rows: make(map[string]int, len(terms))}
+	for i, term := range terms {
+		if _, ok := p.rows[term]; ok {
+			return nil, fmt.Errorf("NewProjection: term %q is in the vocabulary twice", term)
+		}
+		p.rows[term] = i
+	}
+	return p, nil
+}
+
+// Dim is the dimension queries are projected to, which has to match the doc vectors
+func (p *Projection) Dim() int {
+	return len(firstRow(p.Matrix))
+}
+
+// Embed projects a query's analyzed tokens (repeats count as term frequency), weighting each by idf(term), or 1 if idf
+// is nil. Tokens the projection doesn't know are skipped. The result is L2 normalised, which doesn't change the
+// RerankDot ranking but keeps the scores comparable across queries.
+func (p *Projection) Embed(tokens []string, idf func(term string) float64) []float32 {
+	acc := make([]float64, p.Dim())
+	for _, token := range tokens {
+		row, ok := p.rows[token]
+		if !ok {
+			continue
+		}
+		w := 1.0
+		if idf != nil {
+			w = idf(token)
+		}
+		for j, x := range p.Matrix[row] {
+			acc[j] += w * float64(x)
+		}
+	}
+
+	norm := 0.0
+	for _, x := range acc {
+		norm += x * x
+	}
+	norm = math.Sqrt(norm)
+
+	out := make([]float32, len(acc))
+	for j, x := range acc {
+		if norm > 0 {
+			x /= norm
+		}
+		out[j] = float32(x)
+	}
+	return out
+}
+
+// LoadProjection reads the projection matrix .npy at matrixPath (float32 or float64, either order) and the terms of its
+// rows from termsPath, one per line. Without a terms file the rows are taken to be in vocabulary order.
+func LoadProjection(matrixPath, termsPath string, vocab *Vocabulary) (*Projection, error) {
+	matrix, err := LoadFloat32Npy(matrixPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var terms []string
+	if termsPath != "" {
+		terms, err = ReadTerms(termsPath)
+		if err != nil {
+			return nil, err
+		}
+	} else if vocab != nil {
+		terms = vocab.Terms
+	} else {
+		return nil, fmt.Errorf("LoadProjection: %s needs a terms file or a vocabulary", matrixPath)
+	}
+
+	p, err := NewProjection(terms, matrix)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", matrixPath, err)
+	}
+	return p, nil
+}
+
+// ReadTerms reads a file of one term per line
+func ReadTerms(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var terms []string
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 1024), 1024*1024)
+	for sc.Scan() {
+		terms = append(terms, strings.TrimSpace(sc.Text()))
+	}
+	return terms, sc.Err()
+}
+
+func transpose(m [][]float32) [][]float32 {
+	out := make([][]float32, len(firstRow(m)))
+	for j := range out {
+		out[j] = make([]float32, len(m))
+		for i := range m {
+			out[j][i] = m[i][j]
+		}
+	}
+	return out
+}
+
+func firstRow(m [][]float32) []float32 {
+	if len(m) == 0 {
+		return nil
+	}
+	return m[0]
+}
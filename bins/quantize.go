@@ -0,0 +1,431 @@
+package bins
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// VectorEncoding is how each dimension of a PayloadVectors doc is stored in a PIR entry
+type VectorEncoding int
+
+const (
+	EncodingFloat32 VectorEncoding = iota // raw little-endian float32, what Preprocess always used to write
+	EncodingFloat16                       // IEEE half precision
+	EncodingInt8                          // per-dimension scalar quantization, x ~ Offset[i] + Scale[i]*code
+	EncodingPQ                            // product quantization, one byte per subspace, see PQCodebook
+)
+
+func ParseVectorEncoding(s string) (VectorEncoding, error) {
+	switch s {
+	case "float32":
+		return EncodingFloat32, nil
+	case "float16":
+		return EncodingFloat16, nil
+	case "int8":
+		return EncodingInt8, nil
+	case "pq":
+		return EncodingPQ, nil
+	}
+	return 0, fmt.Errorf("unknown vector encoding %q, want float32, float16, int8 or pq", s)
+}
+
+func (e VectorEncoding) String() string {
+	switch e {
+	case EncodingFloat32:
+		return "float32"
+	case EncodingFloat16:
+		return "float16"
+	case EncodingInt8:
+		return "int8"
+	case EncodingPQ:
+		return "pq"
+	}
+	return fmt.Sprintf("VectorEncoding(%d)", int(e))
+}
+
+// BytesPerDim is the size of one dimension in the encoding. PQ codes are per subspace rather than per dimension, so
+// it's 0 for EncodingPQ.
+func (e VectorEncoding) BytesPerDim() int {
+	switch e {
+	case EncodingFloat16:
+		return 2
+	case EncodingInt8:
+		return 1
+	case EncodingPQ:
+		return 0
+	}
+	return 4
+}
+
+// Fitted says whether the encoding is fitted to the vectors, so the bins have to be built with its quantizer
+func (e VectorEncoding) Fitted() bool {
+	return e == EncodingInt8 || e == EncodingPQ
+}
+
+// MarshalText and UnmarshalText keep the encoding readable in the artifact header
+func (e VectorEncoding) MarshalText() ([]byte, error) {
+	return []byte(e.String()), nil
+}
+
+func (e *VectorEncoding) UnmarshalText(text []byte) error {
+	v, err := ParseVectorEncoding(string(text))
+	if err != nil {
+		return err
+	}
+	*e = v
+	return nil
+}
+
+// Quantizer encodes vectors for PIR entries and decodes them on the client. The int8 Scale and Offset are fitted to the
+// vectors by FitQuantizer and stored in the bins artifact header so the client decodes with the same ones. A PQ
+// codebook is too big for the header, it's shipped as its own file and the header only records its checksum.
+type Quantizer struct {
+	Encoding VectorEncoding
+	Dim      int
+	Scale    []float32 `json:",omitempty"` // int8 only
+	Offset   []float32 `json:",omitempty"` // int8 only
+
+	// Vectors is the Matrix.Checksum of the vectors it was fitted to, int8 scales and PQ codebooks only fit those
+	Vectors string `json:",omitempty"`
+
+	Subspaces        int         `json:",omitempty"` // pq only
+	CodebookChecksum string      `json:",omitempty"` // pq only, PQCodebook.Checksum
+	Codebook         *PQCodebook `json:"-"`          // pq only, see AttachCodebook
+}
+
+// NewPQQuantizer wraps a trained codebook in a Quantizer
+func NewPQQuantizer(c *PQCodebook) *Quantizer {
+	return &Quantizer{Encoding: EncodingPQ, Dim: c.Dim, Subspaces: c.Subspaces, CodebookChecksum: c.Checksum(), Codebook: c}
+}
+
+// AttachCodebook hands a PQ quantizer read from an artifact header the codebook it needs to encode and decode, as long
+// as it's the codebook the header was written with
+func (q *Quantizer) AttachCodebook(c *PQCodebook) error {
+	if q.Encoding != EncodingPQ {
+		return fmt.Errorf("quantizer: %v doesn't use a codebook", q.Encoding)
+	}
+	if sum := c.Checksum(); sum != q.CodebookChecksum {
+		return fmt.Errorf("quantizer: codebook checksum %s, the entries were encoded with %s", sum, q.CodebookChecksum)
+	}
+	q.Codebook = c
+	return nil
+}
+
+// FitQuantizer fits a quantizer for the encoding to vectors. For int8 each dimension's [min, max] is mapped onto codes
+// [-127, 127], float32 and float16 don't need fitting. PQ has to be trained with TrainPQ and NewPQQuantizer instead.
+func FitQuantizer(vectors [][]float32, dim int, enc VectorEncoding) *Quantizer {
+	q := &Quantizer{Encoding: enc, Dim: dim}
+	if enc != EncodingInt8 {
+		return q
+	}
+
+	lo := make([]float32, dim)
+	hi := make([]float32, dim)
+	for i := range lo {
+		lo[i] = float32(math.Inf(1))
+		hi[i] = float32(math.Inf(-1))
+	}
+	for _, v := range vectors {
+		for i := 0; i < dim && i < len(v); i++ {
+			lo[i] = min(lo[i], v[i])
+			hi[i] = max(hi[i], v[i])
+		}
+	}
+
+	q.Scale = make([]float32, dim)
+	q.Offset = make([]float32, dim)
+	for i := range lo {
+		if lo[i] > hi[i] { // no vectors
+			continue
+		}
+		q.Offset[i] = (lo[i] + hi[i]) / 2
+		q.Scale[i] = (hi[i] - lo[i]) / 254
+	}
+	return q
+}
+
+// Check makes sure the quantizer can encode Dim dimension vectors
+func (q *Quantizer) Check() error {
+	if q.Dim <= 0 {
+		return fmt.Errorf("quantizer: Dim must be > 0, got %d", q.Dim)
+	}
+	if q.Encoding == EncodingInt8 && (len(q.Scale) != q.Dim || len(q.Offset) != q.Dim) {
+		return fmt.Errorf("quantizer: int8 needs %d scales and offsets, got %d and %d", q.Dim, len(q.Scale), len(q.Offset))
+	}
+	if q.Encoding == EncodingPQ && (q.Subspaces <= 0 || q.Dim%q.Subspaces != 0 || q.CodebookChecksum == "") {
+		return fmt.Errorf("quantizer: pq with %d subspaces over %d dims and codebook %q", q.Subspaces, q.Dim, q.CodebookChecksum)
+	}
+	return nil
+}
+
+// ready is Check, plus making sure a PQ quantizer has its codebook
+func (q *Quantizer) ready() error {
+	if err := q.Check(); err != nil {
+		return err
+	}
+	if q.Encoding == EncodingPQ && q.Codebook == nil {
+		return fmt.Errorf("quantizer: pq codebook %s hasn't been attached", q.CodebookChecksum)
+	}
+	return nil
+}
+
+// BytesPerDoc is the size of one encoded vector
+func (q *Quantizer) BytesPerDoc() int {
+	if q.Encoding == EncodingPQ {
+		return q.Subspaces
+	}
+	return q.Dim * q.Encoding.BytesPerDim()
+}
+
+// Encode writes v into dst, which has to hold BytesPerDoc bytes. Missing dimensions are written as 0.
+func (q *Quantizer) Encode(dst []byte, v []float32) {
+	if q.Encoding == EncodingPQ {
+		if len(v) < q.Dim {
+			v = append(append([]float32(nil), v...), make([]float32, q.Dim-len(v))...)
+		}
+		q.Codebook.Encode(dst, v)
+		return
+	}
+	for i := 0; i < q.Dim; i++ {
+		x := float32(0)
+		if i < len(v) {
+			x = v[i]
+		}
+		switch q.Encoding {
+		case EncodingFloat32:
+			binary.LittleEndian.PutUint32(dst[i*4:], math.Float32bits(x))
+		case EncodingFloat16:
+			binary.LittleEndian.PutUint16(dst[i*2:], float32ToFloat16(x))
+		case EncodingInt8:
+			code := float32(0)
+			if q.Scale[i] > 0 {
+				code = (x - q.Offset[i]) / q.Scale[i]
+			}
+			dst[i] = byte(int8(max(-127, min(127, math.Round(float64(code))))))
+		}
+	}
+}
+
+// Decode reads one encoded vector from src into dst
+func (q *Quantizer) Decode(dst []float32, src []byte) {
+	if q.Encoding == EncodingPQ {
+		q.Codebook.Decode(dst, src)
+		return
+	}
+	for i := 0; i < q.Dim; i++ {
+		switch q.Encoding {
+		case EncodingFloat32:
+			dst[i] = math.Float32frombits(binary.LittleEndian.Uint32(src[i*4:]))
+		case EncodingFloat16:
+			dst[i] = float16ToFloat32(binary.LittleEndian.Uint16(src[i*2:]))
+		case EncodingInt8:
+			dst[i] = q.Offset[i] + q.Scale[i]*float32(int8(src[i]))
+		}
+	}
+}
+
+// RoundTrip is what the client will decode v as
+func (q *Quantizer) RoundTrip(v []float32) []float32 {
+	buf := make([]byte, q.BytesPerDoc())
+	q.Encode(buf, v)
+	out := make([]float32, q.Dim)
+	q.Decode(out, buf)
+	return out
+}
+
+// Scorer returns a function giving the dot product of query with an encoded vector. PQ codes are scored by asymmetric
+// distance (ADC) with one DotTable per query, everything else is decoded first.
+func (q *Quantizer) Scorer(query []float32) func(code []byte) float64 {
+	if q.Encoding == EncodingPQ {
+		table := q.Codebook.DotTable(query)
+		return func(code []byte) float64 { return ADC(table, code) }
+	}
+	v := make([]float32, q.Dim)
+	return func(code []byte) float64 {
+		q.Decode(v, code)
+		return dot(query, v)
+	}
+}
+
+// float32ToFloat16 rounds to the nearest half, ties to even, overflowing to infinity
+func float32ToFloat16(f float32) uint16 {
+	b := math.Float32bits(f)
+	sign := uint16(b>>16) & 0x8000
+	exp := int((b>>23)&0xff) - 127 + 15
+	mant := b & 0x7fffff
+
+	switch {
+	case (b>>23)&0xff == 0xff: // inf or NaN
+		if mant != 0 {
+			return sign | 0x7e00
+		}
+		return sign | 0x7c00
+	case exp >= 0x1f:
+		return sign | 0x7c00
+	case exp <= 0: // subnormal half
+		if exp < -10 {
+			return sign
+		}
+		mant |= 0x800000
+		shift := uint(14 - exp)
+		r := mant >> shift
+		rem := mant & (1<<shift - 1)
+		half := uint32(1) << (shift - 1)
+		if rem > half || (rem == half && r&1 == 1) {
+			r++
+		}
+		return sign | uint16(r)
+	}
+
+	// rounding up can carry into the exponent, which is still the right answer (up to infinity)
+	r := uint32(exp)<<10 | mant>>13
+	rem := mant & 0x1fff
+	if rem > 0x1000 || (rem == 0x1000 && r&1 == 1) {
+		r++
+	}
+	return sign | uint16(r)
+}
+
+func float16ToFloat32(h uint16) float32 {
+	sign := uint32(h&0x8000) << 16
+	exp := uint32(h>>10) & 0x1f
+	mant := uint32(h & 0x3ff)
+
+	switch exp {
+	case 0x1f:
+		return math.Float32frombits(sign | 0x7f800000 | mant<<13)
+	case 0:
+		f := float32(math.Ldexp(float64(mant), -24))
+		if sign != 0 {
+			f = -f
+		}
+		return f
+	}
+	return math.Float32frombits(sign | (exp-15+127)<<23 | mant<<13)
+}
+
+// QuantizationReport is how much a quantizer changes the vectors and what the client does with them
+type QuantizationReport struct {
+	Encoding    VectorEncoding
+	BytesPerDoc int
+
+	MSE         float64 // mean squared error per dimension
+	MaxAbsError float64
+
+	// Nearest neighbours by dot product of Queries sampled vectors among Candidates sampled vectors, the quantized top K
+	// against the float32 top K
+	K          int
+	Queries    int
+	Candidates int
+	RecallAtK  float64 // how many of the true top K the quantized top K recovers
+	ScoreError float64 // mean absolute error of the dot products, i.e. the client's rerank scores
+
+	Collisions int // vectors that decode to the same thing as another vector, so always score the same
+}
+
+// EvaluateQuantizer measures q on vectors: reconstruction error, how many vectors become indistinguishable, and the recall
+// and rerank score impact on a seeded sample of queries and candidates
+func EvaluateQuantizer(q *Quantizer, vectors [][]float32, queries, candidates, k int, seed int64) (QuantizationReport, error) {
+	if err := q.ready(); err != nil {
+		return QuantizationReport{}, err
+	}
+	r := QuantizationReport{Encoding: q.Encoding, BytesPerDoc: q.BytesPerDoc(), K: k}
+
+	// Nothing is kept decoded, all of MS MARCO decoded would be another few GB
+	buf := make([]byte, q.BytesPerDoc())
+	v2 := make([]float32, q.Dim)
+	seen := make(map[[sha256.Size]byte]struct{}, len(vectors))
+	for _, v := range vectors {
+		q.Encode(buf, v)
+		q.Decode(v2, buf)
+		for j := 0; j < q.Dim && j < len(v); j++ {
+			e := float64(v2[j] - v[j])
+			r.MSE += e * e
+			r.MaxAbsError = max(r.MaxAbsError, math.Abs(e))
+		}
+		key := sha256.Sum256(buf)
+		if _, ok := seen[key]; ok {
+			r.Collisions++
+		}
+		seen[key] = struct{}{}
+	}
+	seen = nil
+	if len(vectors) > 0 {
+		r.MSE /= float64(len(vectors) * q.Dim)
+	}
+
+	if len(vectors) == 0 || k <= 0 {
+		return r, nil
+	}
+	rng := rand.New(rand.NewSource(seed))
+	candidates = min(candidates, len(vectors))
+	pool := rng.Perm(len(vectors))[:candidates]
+	k = min(k, candidates)
+	r.Candidates, r.Queries, r.K = candidates, queries, k
+
+	// The client scores the encoded candidates with Scorer, so ADC for PQ
+	encodedPool := make([][]byte, candidates)
+	for i, doc := range pool {
+		encodedPool[i] = make([]byte, q.BytesPerDoc())
+		q.Encode(encodedPool[i], vectors[doc])
+	}
+
+	type scored struct {
+		doc   int
+		score float64
+	}
+	// topK returns the positions in the pool of the k best scoring candidates, and every candidate's score
+	topK := func(score func(i int) float64) ([]scored, []float64) {
+		all := make([]scored, candidates)
+		scores := make([]float64, candidates)
+		for i := range all {
+			scores[i] = score(i)
+			all[i] = scored{i, scores[i]}
+		}
+		sort.Slice(all, func(a, b int) bool {
+			if all[a].score != all[b].score {
+				return all[a].score > all[b].score
+			}
+			return all[a].doc < all[b].doc
+		})
+		return all[:k], scores
+	}
+
+	hits, scoreErr := 0, 0.0
+	for i := 0; i < queries; i++ {
+		qv := vectors[rng.Intn(len(vectors))]
+		exact, exactScores := topK(func(i int) float64 { return dot(qv, vectors[pool[i]]) })
+		scorer := q.Scorer(qv)
+		approx, approxScores := topK(func(i int) float64 { return scorer(encodedPool[i]) })
+
+		want := make(map[int]struct{}, k)
+		for _, s := range exact {
+			want[s.doc] = struct{}{}
+		}
+		for _, s := range approx {
+			if _, ok := want[s.doc]; ok {
+				hits++
+			}
+		}
+		for i, s := range exactScores {
+			scoreErr += math.Abs(approxScores[i] - s)
+		}
+	}
+	if queries > 0 {
+		r.RecallAtK = float64(hits) / float64(queries*k)
+		r.ScoreError = scoreErr / float64(queries*candidates)
+	}
+	return r, nil
+}
+
+func dot(a, b []float32) float64 {
+	s := 0.0
+	for i := 0; i < len(a) && i < len(b); i++ {
+		s += float64(a[i]) * float64(b[i])
+	}
+	return s
+}
@@ -0,0 +1,196 @@
+package bins
+
+import (
+	"math"
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestQuantizer(t *testing.T) {
+	for _, c := range []struct {
+		f    float32
+		bits uint16
+	}{{0, 0}, {1, 0x3c00}, {-2, 0xc000}, {65504, 0x7bff}, {1e6, 0x7c00}, {5.960464477539063e-08, 0x0001}, {0.333251953125, 0x3555}} {
+		if got := float32ToFloat16(c.f); got != c.bits {
+			t.Errorf("float32ToFloat16(%g) = %#04x; want %#04x", c.f, got, c.bits)
+		}
+		if c.bits != 0x7c00 {
+			if got := float16ToFloat32(c.bits); got != c.f {
+				t.Errorf("float16ToFloat32(%#04x) = %g; want %g", c.bits, got, c.f)
+			}
+		}
+	}
+
+	vectors := [][]float32{{0.5, -1, 3}, {-0.25, 2, 3}, {1, 0, 3}, {0, 0.5, 3}}
+	for _, enc := range []VectorEncoding{EncodingFloat32, EncodingFloat16, EncodingInt8} {
+		q := FitQuantizer(vectors, 3, enc)
+
+		// Docs 7 and 0 with room for a third, the zero vector is a real doc and mustn't be taken for padding
+		codec := EntryCodec{Payload: PayloadVectors, Quantizer: q}
+		entry := make([]uint64, codec.EntryWords(3))
+		if err := codec.Encode(entry, []uint32{7, 0}, [][]float32{vectors[0], vectors[1]}); err != nil {
+			t.Fatal(err)
+		}
+		zeros := make([]uint64, codec.EntryWords(1))
+		if err := codec.Encode(zeros, []uint32{3}, [][]float32{make([]float32, 3)}); err != nil {
+			t.Fatal(err)
+		}
+		if docs, _, err := codec.Decode(zeros); err != nil || !reflect.DeepEqual(docs, []uint32{3}) {
+			t.Errorf("%v: zero vector decoded to docs %v, %v; want [3]", enc, docs, err)
+		}
+
+		docs, got, err := codec.Decode(entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(docs, []uint32{7, 0}) || len(got) != 2 {
+			t.Fatalf("%v: decoded docs %v and %d vectors; want [7 0] and 2", enc, docs, len(got))
+		}
+		for i, v := range got {
+			if !reflect.DeepEqual(v, q.RoundTrip(vectors[i])) {
+				t.Errorf("%v: vector %d decoded to %v; want RoundTrip %v", enc, i, v, q.RoundTrip(vectors[i]))
+			}
+			for j := range v {
+				if diff := math.Abs(float64(v[j] - vectors[i][j])); diff > 3.0/254 {
+					t.Errorf("%v: vector %d dim %d off by %g", enc, i, j, diff)
+				}
+			}
+		}
+
+		r, err := EvaluateQuantizer(q, vectors, 4, 4, 2, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if enc == EncodingFloat32 && (r.MSE != 0 || r.RecallAtK != 1) {
+			t.Errorf("float32 should be lossless, got %+v", r)
+		}
+		if r.Collisions != 0 {
+			t.Errorf("%v: %d collisions", enc, r.Collisions)
+		}
+	}
+
+	// The int8 scales travel in the artifact header
+	config := Config{K: 1, D: 1, MaxBins: 1}
+	art, err := NewBinsArtifact([][]string{{"a"}}, BuildStats{TermsPerBin: []uint32{1}}, []string{"a"}, "test", "", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	art.Header.Quantizer = FitQuantizer(vectors, 3, EncodingInt8)
+	path := filepath.Join(t.TempDir(), "q.bins")
+	if err := WriteBinsArtifact(path, art); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadBinsArtifact(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got.Header.Quantizer, art.Header.Quantizer) {
+		t.Errorf("quantizer = %+v; want %+v", got.Header.Quantizer, art.Header.Quantizer)
+	}
+}
+
+func TestKMeansSeparatesClusters(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	centres := [][]float32{{0, 0}, {10, 10}, {-10, 10}}
+	var points [][]float32
+	for i := 0; i < 300; i++ {
+		c := centres[i%3]
+		points = append(points, []float32{c[0] + float32(rng.NormFloat64()), c[1] + float32(rng.NormFloat64())})
+	}
+
+	got := KMeans(points, 3, 20, 1)
+	if len(got) != 3 {
+		t.Fatalf("got %d centroids; want 3", len(got))
+	}
+	for _, c := range centres {
+		_, d := NearestCentroid(got, c)
+		if d > 1 {
+			t.Errorf("no centroid near %v, nearest is %g away", c, math.Sqrt(float64(d)))
+		}
+	}
+}
+
+func TestPQ(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	const dim = 8
+	vectors := make([][]float32, 500)
+	for i := range vectors {
+		vectors[i] = make([]float32, dim)
+		for j := range vectors[i] {
+			vectors[i][j] = float32(rng.NormFloat64())
+		}
+	}
+
+	if _, err := TrainPQ(vectors, dim, 3, 16, 0, 10, 1); err == nil {
+		t.Errorf("TrainPQ accepted 3 subspaces over %d dims", dim)
+	}
+	codebook, err := TrainPQ(vectors, dim, 4, 16, 200, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := NewPQQuantizer(codebook)
+	if q.BytesPerDoc() != 4 {
+		t.Errorf("BytesPerDoc = %d; want 4", q.BytesPerDoc())
+	}
+
+	query := vectors[0]
+	scorer := q.Scorer(query)
+	code := make([]byte, q.BytesPerDoc())
+	for _, v := range vectors[:20] {
+		q.Encode(code, v)
+		if adc, want := scorer(code), dot(query, q.RoundTrip(v)); math.Abs(adc-want) > 1e-4 {
+			t.Errorf("ADC = %g; want the dot product with the reconstruction %g", adc, want)
+		}
+	}
+
+	// PQ should still rank better than chance
+	r, err := EvaluateQuantizer(q, vectors, 20, 200, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.RecallAtK < 0.2 {
+		t.Errorf("recall@10 = %g", r.RecallAtK)
+	}
+
+	// The codebook travels separately from the artifact header, which only has its checksum
+	path := filepath.Join(t.TempDir(), "test.pq")
+	if err := WritePQCodebook(path, codebook); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadPQCodebook(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := &Quantizer{Encoding: EncodingPQ, Dim: dim, Subspaces: 4, CodebookChecksum: q.CodebookChecksum}
+	if _, _, err := (EntryCodec{Payload: PayloadVectors, Quantizer: header}).Decode(make([]uint64, 4)); err == nil {
+		t.Errorf("decoded PQ entries without a codebook")
+	}
+	if err := header.AttachCodebook(read); err != nil {
+		t.Fatal(err)
+	}
+
+	// A code past the 16 centroids is an error, not a panic
+	codec := EntryCodec{Payload: PayloadVectors, Quantizer: header}
+	entry := make([]uint64, codec.EntryWords(1))
+	if err := codec.Encode(entry, []uint32{7}, [][]float32{vectors[0]}); err != nil {
+		t.Fatal(err)
+	}
+	if docs, got, err := codec.Decode(entry); err != nil || docs[0] != 7 || !reflect.DeepEqual(got[0], q.RoundTrip(vectors[0])) {
+		t.Errorf("Decode = %v, %v, %v; want [7] and the round trip of the vector", docs, got, err)
+	}
+	last := EntryHeaderBytes + DocIDBytes + 3 // the code of the last subspace
+	entry[last/8] |= 0xff << (8 * (last % 8))
+	if _, _, err := codec.Decode(entry); err == nil {
+		t.Errorf("decoded a PQ code the codebook doesn't have")
+	}
+
+	other, err := TrainPQ(vectors, dim, 4, 16, 200, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := header.AttachCodebook(other); err == nil {
+		t.Errorf("AttachCodebook accepted a different codebook")
+	}
+}
@@ -0,0 +1,217 @@
+package bins
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+)
+
+// HistogramBucket is the number of items (Count) with a given value (Value)
+type HistogramBucket struct {
+	Value int `json:"value"`
+	Count int `json:"count"`
+}
+
+// BinsReport summarises a bins artifact, see NewBinsReport
+type BinsReport struct {
+	Dataset string `json:"dataset"`
+	Config  Config `json:"config"`
+
+	Bins       int     `json:"bins"`
+	EmptyBins  int     `json:"empty_bins"`
+	Docs       int     `json:"docs"`
+	Postings   uint64  `json:"postings"` // sum of bin sizes
+	MaxRowSize int     `json:"max_row_size"`
+	MeanBin    float64 `json:"mean_bin_size"`
+
+	// Padding every bin to MaxRowSize, as doPIR did before bins spanned several rows
+	PaddingSlots    uint64  `json:"padding_slots"`
+	PaddingOverhead float64 `json:"padding_overhead"` // padding slots / total slots
+	BytesPerDoc     int     `json:"bytes_per_doc"`
+	PaddedDBBytes   uint64  `json:"padded_db_bytes"`
+	PayloadBytes    uint64  `json:"payload_bytes"`
+
+	// Storing each bin as a run of rows of RowSize docs (AutoRowSize), as doPIR does
+	RowSize    int    `json:"row_size"`
+	Rows       int    `json:"rows"`
+	RowDBBytes uint64 `json:"row_db_bytes"`
+
+	// Splitting the bins into size tiers (-tiers), each padded to its largest bin
+	TierBounds    []int  `json:"tier_bounds"`
+	TierBins      []int  `json:"tier_bins"`
+	TieredDBBytes uint64 `json:"tiered_db_bytes"`
+
+	// How many bins each document lands in
+	UnbinnedDocs    int     `json:"unbinned_docs"`
+	MeanReplication float64 `json:"mean_replication"`
+	MaxReplication  int     `json:"max_replication"`
+
+	TermsSearched uint64 `json:"terms_searched"`
+	TermsDropped  uint64 `json:"terms_dropped"` // no more than Threshold hits
+
+	// Bins that several terms hashed into
+	CollidingBins  int `json:"colliding_bins"`
+	MaxTermsPerBin int `json:"max_terms_per_bin"`
+
+	BinSizes    []HistogramBucket `json:"bin_size_histogram"`
+	Replication []HistogramBucket `json:"replication_histogram"`
+	TermsPerBin []HistogramBucket `json:"terms_per_bin_histogram"`
+}
+
+// histogram turns value -> count into buckets sorted by value
+func histogram(counts map[int]int) []HistogramBucket {
+	out := make([]HistogramBucket, 0, len(counts))
+	for v, c := range counts {
+		out = append(out, HistogramBucket{Value: v, Count: c})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Value < out[j].Value })
+	return out
+}
+
+// NewBinsReport works out the diagnostics for an artifact. bytesPerDoc is the size one document takes up in a PIR
+// entry (DocIDBytes+Dim*4 for float32 vectors) and is only used for the byte counts, tiers is how many size tiers the
+// tiered sizes are for.
+func NewBinsReport(a *BinsArtifact, bytesPerDoc int, tiers int) *BinsReport {
+	r := &BinsReport{
+		Dataset:       a.Header.Dataset,
+		Config:        a.Header.Config,
+		Bins:          len(a.Bins),
+		Docs:          len(a.DocIDs),
+		BytesPerDoc:   bytesPerDoc,
+		TermsSearched: a.Header.Searched,
+		TermsDropped:  a.Header.Dropped,
+	}
+
+	sizes := make(map[int]int)
+	replication := make([]int, len(a.DocIDs))
+	for _, bin := range a.Bins {
+		sizes[len(bin)]++
+		if len(bin) == 0 {
+			r.EmptyBins++
+		}
+		r.Postings += uint64(len(bin))
+		r.MaxRowSize = max(r.MaxRowSize, len(bin))
+		for _, doc := range bin {
+			replication[doc]++
+		}
+	}
+	r.BinSizes = histogram(sizes)
+	if r.Bins > 0 {
+		r.MeanBin = float64(r.Postings) / float64(r.Bins)
+	}
+
+	slots := uint64(r.Bins) * uint64(r.MaxRowSize)
+	r.PaddingSlots = slots - r.Postings
+	if slots > 0 {
+		r.PaddingOverhead = float64(r.PaddingSlots) / float64(slots)
+	}
+	r.PaddedDBBytes = slots * uint64(bytesPerDoc)
+	r.PayloadBytes = r.Postings * uint64(bytesPerDoc)
+
+	r.RowSize = AutoRowSize(a)
+	if layout, err := a.RowLayout(r.RowSize); err == nil {
+		r.Rows = layout.NumRows()
+		r.RowDBBytes = uint64(r.Rows) * uint64(r.RowSize) * uint64(bytesPerDoc)
+	}
+	if layout, err := a.TierLayout(tiers, MinPIREntries); err == nil {
+		r.TierBounds, r.TierBins = layout.Bounds, layout.Counts
+		r.TieredDBBytes = layout.PaddedSlots() * uint64(bytesPerDoc)
+	}
+
+	replicated := make(map[int]int)
+	for _, n := range replication {
+		replicated[n]++
+		if n == 0 {
+			r.UnbinnedDocs++
+		}
+		r.MaxReplication = max(r.MaxReplication, n)
+	}
+	r.Replication = histogram(replicated)
+	if r.Docs > 0 {
+		r.MeanReplication = float64(r.Postings) / float64(r.Docs)
+	}
+
+	terms := make(map[int]int)
+	for _, n := range a.TermsPerBin {
+		terms[int(n)]++
+		if n > 1 {
+			r.CollidingBins++
+		}
+		r.MaxTermsPerBin = max(r.MaxTermsPerBin, int(n))
+	}
+	r.TermsPerBin = histogram(terms)
+
+	return r
+}
+
+func (r *BinsReport) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// WriteCSV writes the report as metric,value rows. Histograms become one row per bucket, e.g. bin_size[12],340 means
+// 340 bins hold 12 docs. Keeping it long rather than wide means reports from different configs can just be
+// concatenated.
+func (r *BinsReport) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+
+	u := func(v uint64) string { return strconv.FormatUint(v, 10) }
+	i := strconv.Itoa
+	f := func(v float64) string { return strconv.FormatFloat(v, 'g', 6, 64) }
+
+	rows := [][]string{
+		{"metric", "value"},
+		{"dataset", r.Dataset},
+		{"k", i(int(r.Config.K))},
+		{"d", i(int(r.Config.D))},
+		{"max_bins", i(int(r.Config.MaxBins))},
+		{"threshold", i(int(r.Config.Threshold))},
+		{"bins", i(r.Bins)},
+		{"empty_bins", i(r.EmptyBins)},
+		{"docs", i(r.Docs)},
+		{"postings", u(r.Postings)},
+		{"max_row_size", i(r.MaxRowSize)},
+		{"mean_bin_size", f(r.MeanBin)},
+		{"padding_slots", u(r.PaddingSlots)},
+		{"padding_overhead", f(r.PaddingOverhead)},
+		{"bytes_per_doc", i(r.BytesPerDoc)},
+		{"padded_db_bytes", u(r.PaddedDBBytes)},
+		{"payload_bytes", u(r.PayloadBytes)},
+		{"row_size", i(r.RowSize)},
+		{"rows", i(r.Rows)},
+		{"row_db_bytes", u(r.RowDBBytes)},
+		{"tiered_db_bytes", u(r.TieredDBBytes)},
+		{"unbinned_docs", i(r.UnbinnedDocs)},
+		{"mean_replication", f(r.MeanReplication)},
+		{"max_replication", i(r.MaxReplication)},
+		{"terms_searched", u(r.TermsSearched)},
+		{"terms_dropped", u(r.TermsDropped)},
+		{"colliding_bins", i(r.CollidingBins)},
+		{"max_terms_per_bin", i(r.MaxTermsPerBin)},
+	}
+	for t, bound := range r.TierBounds {
+		rows = append(rows, []string{fmt.Sprintf("tier_bound[%d]", t), i(bound)},
+			[]string{fmt.Sprintf("tier_bins[%d]", t), i(r.TierBins[t])})
+	}
+	for _, h := range []struct {
+		name    string
+		buckets []HistogramBucket
+	}{
+		{"bin_size", r.BinSizes},
+		{"replication", r.Replication},
+		{"terms_per_bin", r.TermsPerBin},
+	} {
+		for _, b := range h.buckets {
+			rows = append(rows, []string{fmt.Sprintf("%s[%d]", h.name, b.Value), i(b.Count)})
+		}
+	}
+
+	if err := cw.WriteAll(rows); err != nil {
+		return err
+	}
+	return cw.Error()
+}
@@ -0,0 +1,218 @@
+package bins
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// RerankMethod is how the client orders the docs it decoded from its bins
+type RerankMethod int
+
+const (
+	RerankNone   RerankMethod = iota // every doc of every bin in the order they were fetched, duplicates included
+	RerankDot                        // dot product of the doc vector with the query embedding
+	RerankCosine                     // cosine similarity of the doc vector with the query embedding
+	RerankBM25                       // sum of the weights (term IDFs) of the bins the doc was in
+	RerankRRF                        // reciprocal rank fusion of the dot product and BM25 rankings
+)
+
+// RRFK is the usual reciprocal rank fusion constant, a doc at rank r scores 1/(RRFK+r)
+const RRFK = 60
+
+func ParseRerankMethod(s string) (RerankMethod, error) {
+	switch s {
+	case "none":
+		return RerankNone, nil
+	case "dot":
+		return RerankDot, nil
+	case "cosine":
+		return RerankCosine, nil
+	case "bm25":
+		return RerankBM25, nil
+	case "rrf":
+		return RerankRRF, nil
+	}
+	return 0, fmt.Errorf("unknown rerank method %q, want none, dot, cosine, bm25 or rrf", s)
+}
+
+func (m RerankMethod) String() string {
+	switch m {
+	case RerankNone:
+		return "none"
+	case RerankDot:
+		return "dot"
+	case RerankCosine:
+		return "cosine"
+	case RerankBM25:
+		return "bm25"
+	case RerankRRF:
+		return "rrf"
+	}
+	return fmt.Sprintf("RerankMethod(%d)", int(m))
+}
+
+// NeedsVectors is whether the method scores docs against a query embedding, so needs vector payloads
+func (m RerankMethod) NeedsVectors() bool {
+	return m == RerankDot || m == RerankCosine
+}
+
+// Retrieved is what the client decoded for one query. Bins[b] is the docs of the b'th bin it fetched, Weights[b] how
+// much being in that bin counts for RerankBM25 (nil counts every bin as 1). Vectors has the vector each doc decoded
+// to, nil for PayloadDocIDs.
+type Retrieved struct {
+	Bins    [][]string
+	Weights []float64
+	Vectors map[string][]float32
+}
+
+// Docs is every doc of every bin in fetch order, duplicates included
+func (r Retrieved) Docs() []string {
+	n := 0
+	for _, bin := range r.Bins {
+		n += len(bin)
+	}
+	docs := make([]string, 0, n)
+	for _, bin := range r.Bins {
+		docs = append(docs, bin...)
+	}
+	return docs
+}
+
+// weight is Weights[b], or 1 if there are no weights
+func (r Retrieved) weight(b int) float64 {
+	if r.Weights == nil {
+		return 1
+	}
+	return r.Weights[b]
+}
+
+// DecodeBins decodes the entries the client got for one query with codec, mapping the doc indices back to the _ids in
+// docIDs (the bins artifact doc dictionary). Vectors is only set for PayloadVectors.
+func DecodeBins(entries [][]uint64, docIDs []string, codec EntryCodec) (Retrieved, error) {
+	r := Retrieved{Bins: make([][]string, len(entries))}
+	if codec.Payload == PayloadVectors {
+		r.Vectors = make(map[string][]float32)
+	}
+	for b, entry := range entries {
+		docs, vectors, err := codec.Decode(entry)
+		if err != nil {
+			return Retrieved{}, fmt.Errorf("DecodeBins: bin %d: %w", b, err)
+		}
+		for j, doc := range docs {
+			if int(doc) >= len(docIDs) {
+				return Retrieved{}, fmt.Errorf("DecodeBins: got doc index %d, but there are only %d docs", doc, len(docIDs))
+			}
+			r.Bins[b] = append(r.Bins[b], docIDs[doc])
+			if vectors != nil {
+				r.Vectors[docIDs[doc]] = vectors[j]
+			}
+		}
+	}
+	return r, nil
+}
+
+// IDF is the BM25 inverse document frequency of term, which RerankBM25 weights the term's bin by. Terms that aren't in
+// the vocabulary get the IDF of a term in no docs.
+func IDF(vocab *Vocabulary, term string) float64 {
+	df := 0.0
+	if i, ok := vocab.Lookup(term); ok {
+		df = float64(vocab.DocFreq[i])
+	}
+	n := float64(vocab.NumDocs)
+	return math.Log(1 + (n-df+0.5)/(df+0.5))
+}
+
+// Rerank dedupes the docs in r and returns the best k (all of them if k is 0) by method. query is the query embedding,
+// which RerankDot and RerankCosine need; RerankRRF only fuses in the dot product ranking when there is one and r has
+// vectors. The bins only ever hold each term's top-K docs rather than their BM25 scores, so RerankBM25 scores a doc by
+// the summed weights of the bins it was fetched from. Ties keep the order the docs were first fetched in.
+func Rerank(method RerankMethod, query []float32, r Retrieved, k int) ([]string, error) {
+	if method == RerankNone {
+		docs := r.Docs()
+		if k > 0 && len(docs) > k {
+			docs = docs[:k]
+		}
+		return docs, nil
+	}
+
+	var docs []string
+	bm25 := make(map[string]float64)
+	for b, bin := range r.Bins {
+		for _, doc := range bin {
+			if _, ok := bm25[doc]; !ok {
+				docs = append(docs, doc)
+			}
+			bm25[doc] += r.weight(b)
+		}
+	}
+
+	haveVectors := query != nil && r.Vectors != nil
+	if method.NeedsVectors() && !haveVectors {
+		return nil, fmt.Errorf("Rerank: %v needs a query embedding and doc vectors", method)
+	}
+	similarity := func(normalise bool) (map[string]float64, error) {
+		scores := make(map[string]float64, len(docs))
+		queryNorm := math.Sqrt(dot(query, query))
+		for _, doc := range docs {
+			v, ok := r.Vectors[doc]
+			if !ok {
+				return nil, fmt.Errorf("Rerank: no vector for doc %s", doc)
+			}
+			s := dot(query, v)
+			if normalise {
+				if norm := queryNorm * math.Sqrt(dot(v, v)); norm > 0 {
+					s /= norm
+				} else {
+					s = 0
+				}
+			}
+			scores[doc] = s
+		}
+		return scores, nil
+	}
+
+	var scores map[string]float64
+	var err error
+	switch method {
+	case RerankDot:
+		scores, err = similarity(false)
+	case RerankCosine:
+		scores, err = similarity(true)
+	case RerankBM25:
+		scores = bm25
+	case RerankRRF:
+		rankings := []map[string]float64{bm25}
+		if haveVectors {
+			dots, err := similarity(false)
+			if err != nil {
+				return nil, err
+			}
+			rankings = append(rankings, dots)
+		}
+		scores = make(map[string]float64, len(docs))
+		for _, ranking := range rankings {
+			for rank, doc := range sortByScore(docs, ranking) {
+				scores[doc] += 1 / float64(RRFK+rank+1)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("Rerank: unknown method %v", method)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ranked := sortByScore(docs, scores)
+	if k > 0 && len(ranked) > k {
+		ranked = ranked[:k]
+	}
+	return ranked, nil
+}
+
+// sortByScore returns a copy of docs, highest score first, ties in their original order
+func sortByScore(docs []string, scores map[string]float64) []string {
+	sorted := append([]string(nil), docs...)
+	sort.SliceStable(sorted, func(i, j int) bool { return scores[sorted[i]] > scores[sorted[j]] })
+	return sorted
+}
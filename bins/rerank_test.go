@@ -0,0 +1,197 @@
+package bins
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/kshedden/gonpy"
+)
+
+func TestRerank(t *testing.T) {
+	r := Retrieved{
+		Bins:    [][]string{{"a", "b"}, {"b", "c"}, {"d"}},
+		Weights: []float64{1, 2, 0.5},
+		Vectors: map[string][]float32{
+			"a": {1, 0},
+			"b": {0, 1},
+			"c": {3, 3},
+			"d": {-1, 0},
+		},
+	}
+	query := []float32{1, 0.5}
+
+	for _, c := range []struct {
+		method RerankMethod
+		k      int
+		want   []string
+	}{
+		{RerankNone, 0, []string{"a", "b", "b", "c", "d"}},
+		{RerankNone, 2, []string{"a", "b"}},
+		{RerankDot, 0, []string{"c", "a", "b", "d"}},
+		{RerankCosine, 0, []string{"c", "a", "b", "d"}}, // c is at 45 degrees, a at 27, b at 63
+		{RerankBM25, 0, []string{"b", "c", "a", "d"}},
+		{RerankBM25, 2, []string{"b", "c"}},
+		{RerankRRF, 0, []string{"c", "b", "a", "d"}},
+	} {
+		got, err := Rerank(c.method, query, r, c.k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("Rerank(%v, k=%d) = %v; want %v", c.method, c.k, got, c.want)
+		}
+	}
+
+	// Doc ID payloads have no vectors, so only the BM25 methods work
+	ids := Retrieved{Bins: r.Bins}
+	if _, err := Rerank(RerankDot, query, ids, 0); err == nil {
+		t.Errorf("RerankDot ranked docs without vectors")
+	}
+	got, err := Rerank(RerankRRF, nil, ids, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"b", "a", "c", "d"}; !reflect.DeepEqual(got, want) { // no weights, every bin counts 1
+		t.Errorf("RRF without vectors = %v; want %v", got, want)
+	}
+
+	vocab := &Vocabulary{Terms: []string{"common", "rare"}, DocFreq: []uint32{90, 1}, NumDocs: 100}
+	if IDF(vocab, "rare") <= IDF(vocab, "common") || IDF(vocab, "unseen") <= IDF(vocab, "rare") {
+		t.Errorf("IDF doesn't favour rarer terms: common %g rare %g unseen %g",
+			IDF(vocab, "common"), IDF(vocab, "rare"), IDF(vocab, "unseen"))
+	}
+
+	codec := EntryCodec{Payload: PayloadDocIDs}
+	entries := make([][]uint64, 2)
+	for i, docs := range [][]uint32{{0, 2}, {1}} {
+		entries[i] = make([]uint64, codec.EntryWords(2))
+		if err := codec.Encode(entries[i], docs, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	decoded, err := DecodeBins(entries, []string{"x", "y", "z"}, codec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := [][]string{{"x", "z"}, {"y"}}; !reflect.DeepEqual(decoded.Bins, want) {
+		t.Errorf("DecodeBins = %v; want %v", decoded.Bins, want)
+	}
+}
+
+func TestEvaluateRun(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "qrels.tsv")
+	qrels := "query-id\tcorpus-id\tscore\nq1\ta\t1\nq1\tb\t2\nq2\tc\t1\nq3\td\t1\n"
+	if err := os.WriteFile(path, []byte(qrels), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	run := map[string][]string{
+		"q1":         {"x", "b", "a"},
+		"q2":         {"x", "y", "z", "c"}, // c is past the cutoff
+		"unjudged-q": {"a"},
+		// q3 is judged but has no answer, so it scores 0
+	}
+	m, err := EvaluateRun(run, path, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Queries != 3 {
+		t.Errorf("evaluated %d queries; want 3", m.Queries)
+	}
+	if want := (1.0 / 2) / 3; math.Abs(m.MRR-want) > 1e-9 {
+		t.Errorf("MRR = %g; want %g", m.MRR, want)
+	}
+	dcg := 2/math.Log2(3) + 1/math.Log2(4)
+	idcg := 2/math.Log2(2) + 1/math.Log2(3)
+	if want := dcg / idcg / 3; math.Abs(m.NDCG-want) > 1e-9 {
+		t.Errorf("nDCG = %g; want %g", m.NDCG, want)
+	}
+}
+
+func TestProjection(t *testing.T) {
+	terms := []string{"cat", "dog", "fish"}
+	// Written dimension x vocabulary in Fortran order as float64, the way an SVD usually comes out of numpy
+	components := []float64{
+		1, 0, // cat
+		0, 1, // dog
+		1, 1, // fish
+	}
+	path := filepath.Join(t.TempDir(), "svd.npy")
+	w, err := gonpy.NewFileWriter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Shape = []int{2, 3}
+	w.ColumnMajor = true
+	if err := w.WriteFloat64(components); err != nil {
+		t.Fatal(err)
+	}
+
+	termsPath := filepath.Join(t.TempDir(), "terms.txt")
+	if err := os.WriteFile(termsPath, []byte("cat\ndog\nfish\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	p, err := LoadProjection(path, termsPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Dim() != 2 || !reflect.DeepEqual(p.Matrix[2], []float32{1, 1}) {
+		t.Fatalf("projection is %dx%d with fish = %v; want 3x2 with fish = [1 1]", len(p.Matrix), p.Dim(), p.Matrix[2])
+	}
+
+	// cat twice at weight 1 and dog once at weight 2 point the same way, unknown terms don't count
+	idf := map[string]float64{"cat": 1, "dog": 2}
+	got := p.Embed([]string{"cat", "dog", "cat", "zebra"}, func(term string) float64 { return idf[term] })
+	if want := float32(1 / math.Sqrt2); math.Abs(float64(got[0]-want)) > 1e-6 || math.Abs(float64(got[1]-want)) > 1e-6 {
+		t.Errorf("Embed = %v; want [%g %g]", got, want, want)
+	}
+	if got := p.Embed([]string{"zebra"}, nil); got[0] != 0 || got[1] != 0 {
+		t.Errorf("Embed of unknown terms = %v; want zeros", got)
+	}
+
+	// Without a terms file the rows are in vocabulary order
+	p, err = LoadProjection(path, "", &Vocabulary{Terms: terms})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(p.Matrix[1], []float32{0, 1}) {
+		t.Errorf("dog = %v; want [0 1]", p.Matrix[1])
+	}
+	if _, err := LoadProjection(path, "", &Vocabulary{Terms: append(terms, "horse")}); err == nil {
+		t.Errorf("LoadProjection accepted 4 vocabulary terms for a 2x3 matrix")
+	}
+}
+
+func TestDecodeBinsVectors(t *testing.T) {
+	vectors := [][]float32{{1, 2}, {1, 2}, {3, 4}} // docs x and y have the same vector
+	codec := EntryCodec{Payload: PayloadVectors, Quantizer: FitQuantizer(vectors, 2, EncodingFloat16)}
+
+	entries := make([][]uint64, 2)
+	for i, docs := range [][]uint32{{0, 1}, {2}} {
+		entries[i] = make([]uint64, codec.EntryWords(2))
+		var vs [][]float32
+		for _, doc := range docs {
+			vs = append(vs, vectors[doc])
+		}
+		if err := codec.Encode(entries[i], docs, vs); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r, err := DecodeBins(entries, []string{"x", "y", "z"}, codec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := [][]string{{"x", "y"}, {"z"}}; !reflect.DeepEqual(r.Bins, want) {
+		t.Errorf("DecodeBins = %v; want %v, identical vectors shouldn't collide", r.Bins, want)
+	}
+	if !reflect.DeepEqual(r.Vectors["z"], []float32{3, 4}) {
+		t.Errorf("z decoded to %v", r.Vectors["z"])
+	}
+	if _, err := DecodeBins(entries, []string{"x"}, codec); err == nil {
+		t.Errorf("DecodeBins accepted a doc index outside the dictionary")
+	}
+}
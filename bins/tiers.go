@@ -0,0 +1,189 @@
+package bins
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+)
+
+// DefaultTiers is how many size classes the bins report works out tiered sizes for
+const DefaultTiers = 4
+
+// TierLayout groups bins into size classes, each its own PIR DB padded only to the largest bin in the class. Tier t
+// holds bins of up to Bounds[t] docs, bin b is entry Index[b] of tier Tier[b]. Like RowLayout it only depends on the
+// bin sizes, so the client builds the same table from the bins artifact.
+//
+// Like RowLayout.Stripe, the bins of a tier are dealt out over its PIR partitions: the i'th bin of tier t is in
+// partition i%PIRPartitions, so the padding entries are spread over the partitions rather than filling the last ones
+// and leaving the bins to fewer partitions than Piano answers queries from.
+type TierLayout struct {
+	Bounds []int
+	Counts []int // bins in each tier
+	Tier   []int
+	Index  []uint64
+}
+
+// TierBounds picks up to tiers bounds for bins of the given sizes, so that padding each bin to its tier's bound takes
+// the fewest slots. Every bound is the size of some bin, so there are fewer bounds than tiers when there are fewer
+// distinct sizes. Every tier holds at least minBins bins (all of them, in one tier, if there are fewer): left to
+// itself the split puts the few largest bins in a tier of their own, and every tier is a PIR DB that gets padded to
+// MinPIREntries entries of its largest bin.
+func TierBounds(sizes []int, tiers int, minBins int) []int {
+	counts := make(map[int]int)
+	for _, n := range sizes {
+		counts[n]++
+	}
+	values := make([]int, 0, len(counts))
+	for n := range counts {
+		values = append(values, n)
+	}
+	sort.Ints(values)
+	m := len(values)
+	tiers = min(tiers, m)
+	if tiers == 0 {
+		return nil
+	}
+
+	// below[j] is the number of bins smaller than values[j]
+	below := make([]int, m+1)
+	for j, n := range values {
+		below[j+1] = below[j] + counts[n]
+	}
+	// cost[k][j] is the fewest slots for the bins up to values[j-1] in k tiers, from[k][j] where the last tier starts
+	const inf = ^uint64(0)
+	cost := make([][]uint64, tiers+1)
+	from := make([][]int, tiers+1)
+	for k := range cost {
+		cost[k] = make([]uint64, m+1)
+		from[k] = make([]int, m+1)
+		for j := range cost[k] {
+			cost[k][j] = inf
+		}
+	}
+	cost[0][0] = 0
+	for k := 1; k <= tiers; k++ {
+		for j := k; j <= m; j++ {
+			for i := k - 1; i < j; i++ {
+				if cost[k-1][i] == inf || below[j]-below[i] < minBins {
+					continue
+				}
+				c := cost[k-1][i] + uint64(below[j]-below[i])*uint64(values[j-1])
+				if c < cost[k][j] {
+					cost[k][j], from[k][j] = c, i
+				}
+			}
+		}
+	}
+
+	// fewer tiers can be cheaper once they have to be minBins bins each
+	best := 0
+	for k := 1; k <= tiers; k++ {
+		if cost[k][m] != inf && (best == 0 || cost[k][m] < cost[best][m]) {
+			best = k
+		}
+	}
+	if best == 0 {
+		return []int{values[m-1]}
+	}
+	bounds := make([]int, best)
+	for k, j := best, m; k > 0; k-- {
+		bounds[k-1] = values[j-1]
+		j = from[k][j]
+	}
+	return bounds
+}
+
+// NewTierLayout puts bins of the given sizes into the smallest tier they fit, bounds has to be ascending
+func NewTierLayout(sizes []int, bounds []int) (TierLayout, error) {
+	if len(bounds) == 0 && len(sizes) > 0 {
+		return TierLayout{}, fmt.Errorf("NewTierLayout: no tiers for %d bins", len(sizes))
+	}
+	for t := 1; t < len(bounds); t++ {
+		if bounds[t] <= bounds[t-1] {
+			return TierLayout{}, fmt.Errorf("NewTierLayout: bounds %v aren't ascending", bounds)
+		}
+	}
+	l := TierLayout{Bounds: bounds, Counts: make([]int, len(bounds)), Tier: make([]int, len(sizes)), Index: make([]uint64, len(sizes))}
+	for b, n := range sizes {
+		t := sort.SearchInts(bounds, n)
+		if t == len(bounds) {
+			return TierLayout{}, fmt.Errorf("NewTierLayout: bin %d has %d docs, more than the largest tier holds (%d)", b, n, bounds[len(bounds)-1])
+		}
+		l.Tier[b], l.Index[b] = t, uint64(l.Counts[t])
+		l.Counts[t]++
+	}
+	for b, i := range l.Index {
+		size := uint64(PIREntries(l.Counts[l.Tier[b]]) / PIRPartitions)
+		l.Index[b] = i%PIRPartitions*size + i/PIRPartitions
+	}
+	return l, nil
+}
+
+// TierLayout puts the artifact's bins into (up to) tiers size classes of at least minBins bins, see TierBounds
+func (a *BinsArtifact) TierLayout(tiers int, minBins int) (TierLayout, error) {
+	sizes := make([]int, len(a.Bins))
+	for b, bin := range a.Bins {
+		sizes[b] = len(bin)
+	}
+	return NewTierLayout(sizes, TierBounds(sizes, tiers, minBins))
+}
+
+// Bins is the number of bins in the layout
+func (l TierLayout) Bins() int {
+	return len(l.Tier)
+}
+
+// PaddedSlots is the doc slots in all the tiers, padding included (the empty entries Split adds too)
+func (l TierLayout) PaddedSlots() uint64 {
+	slots := uint64(0)
+	for t, bound := range l.Bounds {
+		slots += uint64(PIREntries(l.Counts[t])) * uint64(bound)
+	}
+	return slots
+}
+
+// Split sorts the bins of DB into their tiers, in entry order. Each tier is a DB of PIREntries(Counts[t]) entries, the
+// ones without a bin are empty and aren't in Counts.
+func (l TierLayout) Split(DB [][]uint32) ([][][]uint32, error) {
+	if len(DB) != l.Bins() {
+		return nil, fmt.Errorf("TierLayout.Split: %d bins but the layout has %d", len(DB), l.Bins())
+	}
+	tiers := make([][][]uint32, len(l.Bounds))
+	for t := range tiers {
+		tiers[t] = make([][]uint32, PIREntries(l.Counts[t]))
+	}
+	for b, bin := range DB {
+		tiers[l.Tier[b]][l.Index[b]] = bin
+	}
+	return tiers, nil
+}
+
+// TierBatch is what one query sends to the tiers. Every tier gets exactly as many sub-queries, whichever bins the
+// query wants, so the server can't tell which tiers the bins are in. Indices[t] is the entries asked of tier t and
+// Slots[t][j] which of the wanted bins Indices[t][j] is, -1 for the random padding queries.
+type TierBatch struct {
+	Indices [][]uint64
+	Slots   [][]int
+	Dropped int // wanted bins that didn't fit in their tier's perTier sub-queries
+}
+
+// Batch spreads the wanted bins over the tiers' sub-queries, perTier to each tier
+func (l TierLayout) Batch(bins []uint64, perTier int, rng *rand.Rand) TierBatch {
+	batch := TierBatch{Indices: make([][]uint64, len(l.Bounds)), Slots: make([][]int, len(l.Bounds))}
+	for i, b := range bins {
+		t := l.Tier[b]
+		if len(batch.Indices[t]) == perTier {
+			batch.Dropped++
+			continue
+		}
+		batch.Indices[t] = append(batch.Indices[t], l.Index[b])
+		batch.Slots[t] = append(batch.Slots[t], i)
+	}
+	for t := range batch.Indices {
+		for len(batch.Indices[t]) < perTier {
+			batch.Indices[t] = append(batch.Indices[t], uint64(rng.Intn(PIREntries(l.Counts[t]))))
+			batch.Slots[t] = append(batch.Slots[t], -1)
+		}
+	}
+	return batch
+}
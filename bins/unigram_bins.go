@@ -13,7 +13,12 @@ import (
 	"crypto/sha256"
 	"encoding/binary"
 	"fmt"
+	"os"
 	"regexp"
+	"runtime"
+	"slices"
+	"sort"
+	"sync"
 
 	"github.com/blugelabs/bluge"
 	"github.com/blugelabs/bluge/analysis"
@@ -31,6 +36,23 @@ type Config struct {
 	MaxBins   uint
 	Filenames bool
 	Threshold uint
+	Binning   Binning        // BinUnigram (the zero value) or BinKMeans, see MakeClusterDB
+	Encoding  VectorEncoding `json:"-"` // how PayloadVectors entries store each vector, see Quantizer
+	Subspaces uint           `json:"-"` // PQ subspaces (bytes per doc) when Encoding is EncodingPQ
+	Workers   uint           `json:"-"` // goroutines running term searches, 0 uses GOMAXPROCS
+
+	Checkpoint      string `json:"-"` // file the partial bins are saved to while building, "" disables checkpointing
+	CheckpointEvery uint   `json:"-"` // vocabulary terms between checkpoints, 0 uses DefaultCheckpointEvery
+}
+
+const DefaultCheckpointEvery = 100000
+
+// workers returns how many search goroutines MakeUnigramDB should run
+func (c Config) workers() int {
+	if c.Workers == 0 {
+		return runtime.GOMAXPROCS(0)
+	}
+	return int(c.Workers)
 }
 
 func doBM25Search(queries []string, path_to_corpus string) {
@@ -56,152 +78,172 @@ func strictEnglishAnalyzer() *analysis.Analyzer {
 }
 
 // TODO: Replace bluge.reader with a generic implements
-func MakeUnigramDB(reader *bluge.Reader, dataset DatasetMetadata, config Config) [][]string {
+func MakeUnigramDB(reader *bluge.Reader, dataset DatasetMetadata, config Config) ([][]string, BuildStats) {
+	vocab, err := ScanVocabulary(dataset.OriginalDir)
+	Must(err)
 
-	//tokeniser := en.NewAnalyzer()
+	return MakeUnigramDBFromVocabulary(reader, vocab, dataset, config)
+}
 
-	tokeniser := strictEnglishAnalyzer()
+// MakeUnigramDBFromVocabulary bins the top-K documents of every term in vocab, see ScanVocabulary and
+// VocabularyFromIndex for where the vocabulary can come from.
+func MakeUnigramDBFromVocabulary(reader *bluge.Reader, vocab *Vocabulary, dataset DatasetMetadata, config Config) ([][]string, BuildStats) {
+	binsSlice, stats, err := MergePartialBins([]*PartialBins{MakeUnigramShard(reader, vocab, dataset, config, 0, 1)})
+	Must(err)
 
-	//logrus.Info("Making Unigram Database")
-	//queries, er := LoadQueries(dataset.Queries)
-	//Must(er)
-	//qrels, er := loadQrels(dataset.Qrels)
-	// Must(er)
-	// MAP for debugging
-	counts := make(map[string]int)
-	docs, er := LoadCorpus(dataset.OriginalDir)
-	Must(er)
+	logrus.Infof("Vocab size/trueDBsize =%d", vocab.Len())
+	if vocab.Tokens > 0 {
+		logrus.Infof("Number of duplicates =%d", vocab.Tokens-uint64(vocab.Len()))
+	}
 
-	total_items_in_set := 0
+	logrus.Infof("Terms dropped by Threshold =%d", stats.Dropped)
 
-	bar := progressbar.Default(int64(len(docs)), fmt.Sprintf("Scanning Vocab for %s", dataset.Name))
+	return binsSlice, stats
+}
 
-	// No sets in go, gotta make my own...
-	set := make(map[string]struct{})
+// MakeUnigramShard bins the terms of one of shards contiguous slices of the vocabulary (see ShardRange). Each shard can
+// run in its own process, MergePartialBins then combines them into the same table a single process would build.
+func MakeUnigramShard(reader *bluge.Reader, vocab *Vocabulary, dataset DatasetMetadata, config Config, shard, shards uint) *PartialBins {
+	start, end := ShardRange(vocab.Len(), shard, shards)
 
-	for _, doc := range docs {
+	builder := newBinBuilder()
+	next := start
 
-		title := doc.Title
-		text := doc.Text
-		if text == "" {
-			text = doc.Abstract
+	if config.Checkpoint != "" {
+		cp, err := loadCheckpoint(config.Checkpoint, vocab, config, shard, shards)
+		Must(err)
+		if cp != nil {
+			logrus.Infof("Resuming from checkpoint %s at term %d of [%d, %d)", config.Checkpoint, cp.End, start, end)
+			cp.addTo(builder)
+			next = cp.End
 		}
+	}
 
-		result := title + " " + text
-
-		tokens := tokeniser.Analyze([]byte(result))
-
-		for _, t := range tokens {
-			logrus.Tracef("%q term=%q start=%d end=%d posIncr=%d\n",
-				result[t.Start:t.End], t.Term, t.Start, t.End, t.PositionIncr)
-			word := fmt.Sprintf("%s", t.Term)
-			_, ok := set[word]
-
-			if _, ok := counts[word]; !ok {
-				// not in map yet → initialize to 1
-				counts[word] = 1
-			} else {
-				// already there → increment
-				counts[word]++
-			}
+	bar := progressbar.Default(int64(end-start), fmt.Sprintf("Putting items into bins %s (shard %d/%d)", dataset.Name, shard, shards))
+	bar.Add(next - start)
 
-			if !ok {
-				total_items_in_set++
-			}
-			set[word] = struct{}{}
+	for next < end {
+		chunkEnd := end
+		if config.Checkpoint != "" {
+			chunkEnd = min(next+config.checkpointEvery(), end)
 		}
 
-		bar.Add(1)
+		// The searches run in parallel, but only this goroutine ever touches the builder. Bins are sets, so the order
+		// the results arrive in doesn't matter once they are sorted.
+		searchTerms(reader, vocab.Terms[next:chunkEnd], config, func(hits termHits) {
+			bar.Add(1)
+			builder.addTerm(hits, config)
+		})
+		next = chunkEnd
 
+		if config.Checkpoint != "" && next < end {
+			Must(WritePartialBins(config.Checkpoint, newPartialBins(vocab, config, shard, shards, start, next, builder)))
+		}
 	}
 
 	bar.Finish()
 
-	// Very 'hacky' a mapping to a 'set' which is a mapping to structs. Is converted into a regular bin at the end.
-	setsBins := make(map[uint]map[string]struct{})
-
-	bar = progressbar.Default(int64(len(docs)), fmt.Sprintf("Putting items into bins %s", dataset.Name))
-
-	for word := range set {
-
-		bar.Add(1)
-		// Perform BM25 search using each individual word as the Query
-
-		matchTitle := bluge.NewMatchQuery(word).SetField("title")
-		matchBody := bluge.NewMatchQuery(word).SetField("body")
-		boolean := bluge.NewBooleanQuery().
-			AddShould(matchTitle).
-			AddShould(matchBody)
+	if config.Checkpoint != "" {
+		// The shard is finished, a stale checkpoint would only get in the way of the next build
+		if err := os.Remove(config.Checkpoint); err != nil && !os.IsNotExist(err) {
+			logrus.Warnf("Could not remove checkpoint %s: %v", config.Checkpoint, err)
+		}
+	}
 
-		req := bluge.NewTopNSearch(int(config.K), boolean)
-		it, err := reader.Search(context.Background(), req)
+	return newPartialBins(vocab, config, shard, shards, start, end, builder)
+}
 
-		var doc_ids []string
+// termHits holds the top-K documents for a single vocabulary term
+type termHits struct {
+	word   string
+	docIDs []string
+}
 
-		for {
-			match, err := it.Next()
-			if err != nil {
-				break
-			}
-			if match == nil { // Should I do something if we have too few items??
-				break
+// searchTerms runs a BM25 top-K search for every term using config.workers() goroutines that share the (read-only)
+// reader. fn is called once per term, always from the calling goroutine, so it doesn't need any locking.
+func searchTerms(reader *bluge.Reader, terms []string, config Config, fn func(termHits)) {
+	workers := config.workers()
+
+	jobs := make(chan string, workers*4)
+	results := make(chan termHits, workers*4)
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for word := range jobs {
+				docIDs, err := searchTerm(reader, word, config.K)
+				Must(err)
+				results <- termHits{word: word, docIDs: docIDs}
 			}
+		}()
+	}
 
-			// pull out the stored "_id" field instead of match.ID()
-			var docID string
-			err = match.VisitStoredFields(func(field string, value []byte) bool {
-				if field == "_id" {
-					docID = string(value)
-					// storedIDs = append(storedIDs, docID)
-				}
-				return true // keep scanning other stored fields
-			})
-			Must(err)
-
-			doc_ids = append(doc_ids, docID)
-		}
-
-		if len(doc_ids) <= int(config.Threshold) {
-			continue
+	go func() {
+		for _, word := range terms {
+			jobs <- word
 		}
+		close(jobs)
+		wg.Wait()
+		close(results)
+	}()
 
-		Must(err)
-
-		var storedIDs []string
-		// var counter := 0
-
-		for rank := uint(0); rank <= config.K; rank++ {
-
-			if int(rank) >= len(doc_ids) { // Ran out of hits
-				break
-			}
-			storedIDs = append(storedIDs, doc_ids[rank])
-
-			// Now to do the actual 'binning' for each unigram.
-			for d := uint(0); d <= config.D; d++ {
+	for hits := range results {
+		fn(hits)
+	}
+}
 
-				var bin_index = hashTokenChoice(word, d)
+// searchTerm performs a BM25 search using an individual word as the Query and returns the stored "_id" of each hit
+func searchTerm(reader *bluge.Reader, word string, k uint) ([]string, error) {
+	matchTitle := bluge.NewMatchQuery(word).SetField("title")
+	matchBody := bluge.NewMatchQuery(word).SetField("body")
+	boolean := bluge.NewBooleanQuery().
+		AddShould(matchTitle).
+		AddShould(matchBody)
+
+	req := bluge.NewTopNSearch(int(k), boolean)
+	it, err := reader.Search(context.Background(), req)
+	if err != nil {
+		return nil, err
+	}
 
-				if config.Filenames {
-					for _, docID := range storedIDs {
-						add(setsBins, uint(bin_index)%config.MaxBins, docID)
-					}
-				} else {
-					for _, storedID := range storedIDs {
-						add(setsBins, uint(bin_index)%config.MaxBins, storedID)
-					}
-				}
+	var docIDs []string
+	for {
+		match, err := it.Next()
+		if err != nil {
+			break
+		}
+		if match == nil { // Should I do something if we have too few items??
+			break
+		}
 
+		// pull out the stored "_id" field instead of match.ID()
+		var docID string
+		err = match.VisitStoredFields(func(field string, value []byte) bool {
+			if field == "_id" {
+				docID = string(value)
 			}
-
+			return true // keep scanning other stored fields
+		})
+		if err != nil {
+			return nil, err
 		}
 
+		docIDs = append(docIDs, docID)
 	}
 
-	bar.Finish()
-	binsSlice := make([][]string, config.MaxBins)
+	return docIDs, nil
+}
 
-	for bin, set := range setsBins {
+// binSets maps a bin index to the set of document IDs in it
+type binSets map[uint]map[string]struct{}
+
+// toSlice converts the sets into a regular bin table, every bin is sorted so the result doesn't depend on map order
+func (sets binSets) toSlice(maxBins uint) [][]string {
+	binsSlice := make([][]string, maxBins)
+
+	for bin, set := range sets {
 		idx := int(bin)
 
 		// Pre-size capacity to avoid re-allocs while appending
@@ -209,26 +251,68 @@ func MakeUnigramDB(reader *bluge.Reader, dataset DatasetMetadata, config Config)
 		for w := range set {
 			binsSlice[idx] = append(binsSlice[idx], w)
 		}
-
+		sort.Strings(binsSlice[idx])
 	}
 
-	// counters
-	numKeys := 0
-	sumValues := 0
+	return binsSlice
+}
+
+// BuildStats are the numbers about a build that can't be recovered from the bins themselves
+type BuildStats struct {
+	Searched    uint64   // vocabulary terms searched
+	Dropped     uint64   // terms with no more than Threshold hits, which weren't binned
+	TermsPerBin []uint32 // distinct terms hashed into each bin, more than one is a collision
+}
 
-	for _, v := range counts {
-		numKeys++
-		sumValues += v
+// binBuilder accumulates the bins of a build along with its BuildStats
+type binBuilder struct {
+	sets        binSets
+	termsPerBin map[uint]uint32
+	searched    uint64
+	dropped     uint64
+}
+
+func newBinBuilder() *binBuilder {
+	return &binBuilder{
+		// Very 'hacky' a mapping to a 'set' which is a mapping to structs. Is converted into a regular bin at the end.
+		sets:        make(binSets),
+		termsPerBin: make(map[uint]uint32),
 	}
+}
 
-	logrus.Infof("Vocab size/trueDBsize =%d", numKeys)
-	logrus.Infof("Number of duplicates =%d", (sumValues - numKeys))
+func (b *binBuilder) addTerm(hits termHits, config Config) {
+	b.searched++
+	if len(hits.docIDs) <= int(config.Threshold) {
+		b.dropped++
+		return
+	}
+	for _, bin := range binTerm(b.sets, hits, config) {
+		b.termsPerBin[bin]++
+	}
+}
 
-	return binsSlice
+// binTerm does the actual 'binning' for a unigram, every hit goes into each of the D+1 hash choices for the word. It
+// returns the distinct bins the word went into.
+func binTerm(setsBins binSets, hits termHits, config Config) []uint {
+	docIDs := hits.docIDs
+	if uint(len(docIDs)) > config.K {
+		docIDs = docIDs[:config.K]
+	}
 
+	binned := make([]uint, 0, config.D+1)
+	for d := uint(0); d <= config.D; d++ {
+		var bin_index = uint(hashTokenChoice(hits.word, d)) % config.MaxBins
+		for _, docID := range docIDs {
+			add(setsBins, bin_index, docID)
+		}
+		if !slices.Contains(binned, bin_index) {
+			binned = append(binned, bin_index)
+		}
+	}
+	return binned
 }
 
-func add(sets map[uint]map[string]struct{}, bin uint, word string) {
+func add(sets binSets, bin uint, word string) {
 	if sets[bin] == nil {
 		sets[bin] = make(map[string]struct{})
 	}
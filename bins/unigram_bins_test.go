@@ -0,0 +1,264 @@
+package bins
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/blugelabs/bluge"
+)
+
+var testDocs = []string{
+	"The quick brown fox jumps over the lazy dog",
+	"A lazy afternoon spent reading about foxes and dogs",
+	"Private information retrieval lets a client fetch a record privately",
+	"BM25 ranks documents by term frequency and inverse document frequency",
+	"Dogs and foxes are both canines, but foxes are smaller",
+	"Retrieval augmented generation fetches documents for a language model",
+	"The client stores hints so the server does the heavy lifting",
+	"Quick retrieval of brown documents by a lazy server",
+}
+
+// makeTestDataset writes testDocs as a BEIR corpus, indexes it and returns the dataset and an open reader
+func makeTestDataset(t *testing.T) (DatasetMetadata, *bluge.Reader) {
+	t.Helper()
+	dir := t.TempDir()
+
+	corpus := filepath.Join(dir, "corpus.jsonl")
+	f, err := os.Create(corpus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, text := range testDocs {
+		fmt.Fprintf(f, "{\"_id\": \"%d\", \"title\": \"\", \"text\": %q}\n", i, text)
+	}
+	f.Close()
+
+	indexDir := filepath.Join(dir, "index")
+	LoadBeirJSONL(corpus, indexDir)
+
+	reader, err := bluge.OpenReader(bluge.DefaultConfig(indexDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { reader.Close() })
+
+	return DatasetMetadata{Name: "test", IndexDir: indexDir, OriginalDir: corpus}, reader
+}
+
+func TestMakeUnigramDBDeterministic(t *testing.T) {
+	dataset, reader := makeTestDataset(t)
+
+	config := Config{K: 4, D: 1, MaxBins: 13, Threshold: 0, Workers: 1}
+	want, wantStats := MakeUnigramDB(reader, dataset, config)
+
+	nonEmpty := 0
+	for _, bin := range want {
+		if len(bin) > 0 {
+			nonEmpty++
+		}
+	}
+	if nonEmpty == 0 {
+		t.Fatalf("expected some non-empty bins, got %v", want)
+	}
+
+	for _, workers := range []uint{2, 8} {
+		config.Workers = workers
+		got, gotStats := MakeUnigramDB(reader, dataset, config)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Workers=%d: bins differ from the single worker build\ngot  %v\nwant %v", workers, got, want)
+		}
+		if !reflect.DeepEqual(gotStats, wantStats) {
+			t.Errorf("Workers=%d: stats = %+v; want %+v", workers, gotStats, wantStats)
+		}
+	}
+}
+
+func TestMakeUnigramDBResumesFromCheckpoint(t *testing.T) {
+	dataset, reader := makeTestDataset(t)
+	vocab, err := ScanVocabulary(dataset.OriginalDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := Config{K: 4, D: 1, MaxBins: 13, Threshold: 1, Workers: 2}
+	want, wantStats := MakeUnigramDBFromVocabulary(reader, vocab, dataset, config)
+
+	// Pretend the job was killed after binning half the vocabulary
+	half := vocab.Len() / 2
+	builder := newBinBuilder()
+	searchTerms(reader, vocab.Terms[:half], config, func(hits termHits) {
+		builder.addTerm(hits, config)
+	})
+	config.Checkpoint = filepath.Join(t.TempDir(), "bins.ckpt")
+	config.CheckpointEvery = 3
+	if err := WritePartialBins(config.Checkpoint, newPartialBins(vocab, config, 0, 1, 0, half, builder)); err != nil {
+		t.Fatal(err)
+	}
+
+	got, gotStats := MakeUnigramDBFromVocabulary(reader, vocab, dataset, config)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("resumed bins differ from an uninterrupted build\ngot  %v\nwant %v", got, want)
+	}
+	if !reflect.DeepEqual(gotStats, wantStats) {
+		t.Errorf("resumed stats = %+v; want %+v", gotStats, wantStats)
+	}
+	if _, err := os.Stat(config.Checkpoint); !os.IsNotExist(err) {
+		t.Errorf("checkpoint should be removed once the build finishes, stat err = %v", err)
+	}
+
+	// A checkpoint from another config must not be resumed
+	if err := WritePartialBins(config.Checkpoint, newPartialBins(vocab, config, 0, 1, 0, half, builder)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadCheckpoint(config.Checkpoint, vocab, config, 1, 2); err == nil {
+		t.Errorf("loadCheckpoint accepted a checkpoint for another shard")
+	}
+	config.K = 5
+	if _, err := loadCheckpoint(config.Checkpoint, vocab, config, 0, 1); err == nil {
+		t.Errorf("loadCheckpoint accepted a checkpoint built with a different K")
+	}
+}
+
+func TestMergePartialBins(t *testing.T) {
+	dataset, reader := makeTestDataset(t)
+	vocab, err := ScanVocabulary(dataset.OriginalDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := Config{K: 4, D: 2, MaxBins: 11, Threshold: 1}
+	want, wantStats := MakeUnigramDBFromVocabulary(reader, vocab, dataset, config)
+	if wantStats.Searched != uint64(vocab.Len()) {
+		t.Errorf("Searched = %d; want %d", wantStats.Searched, vocab.Len())
+	}
+
+	const shards = 3
+	var parts []*PartialBins
+	// Shards are merged in any order
+	for shard := uint(shards); shard > 0; shard-- {
+		path := filepath.Join(t.TempDir(), fmt.Sprintf("shard-%d.part", shard-1))
+		if err := WritePartialBins(path, MakeUnigramShard(reader, vocab, dataset, config, shard-1, shards)); err != nil {
+			t.Fatal(err)
+		}
+		p, err := ReadPartialBins(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts = append(parts, p)
+	}
+
+	got, gotStats, err := MergePartialBins(parts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("merged bins differ from a single process build\ngot  %v\nwant %v", got, want)
+	}
+	if !reflect.DeepEqual(gotStats, wantStats) {
+		t.Errorf("merged stats = %+v; want %+v", gotStats, wantStats)
+	}
+
+	if _, _, err := MergePartialBins(parts[1:]); err == nil {
+		t.Errorf("MergePartialBins accepted a build with a missing shard")
+	}
+	if _, _, err := MergePartialBins(append(parts, parts[0])); err == nil {
+		t.Errorf("MergePartialBins accepted a shard twice")
+	}
+}
+
+func TestPlanConfigsBoundsTheBuild(t *testing.T) {
+	dataset, reader := makeTestDataset(t)
+	vocab, err := ScanVocabulary(dataset.OriginalDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plans := PlanConfigs(vocab, PlanTarget{BytesPerDoc: 16, D: 1, Ks: []uint{2, 4}, BinDivisors: []uint{1, 2}, BatchSize: 32, FailureProbLog2: 8})
+	if len(plans) != 4 {
+		t.Fatalf("got %d plans; want 4", len(plans))
+	}
+	for _, p := range plans {
+		DB, stats := MakeUnigramDBFromVocabulary(reader, vocab, dataset, p.Config)
+		maxRow := 0
+		for _, bin := range DB {
+			maxRow = max(maxRow, len(bin))
+		}
+		if maxRow > p.MaxRowSize {
+			t.Errorf("%+v: built max_row_size %d, planned at most %d", p.Config, maxRow, p.MaxRowSize)
+		}
+		if kept := stats.Searched - stats.Dropped; kept > p.KeptTerms {
+			t.Errorf("%+v: kept %d terms, planned at most %d", p.Config, kept, p.KeptTerms)
+		}
+		if p.EntryBytes%32 != 0 {
+			t.Errorf("%+v: entry bytes %d not a multiple of 32", p.Config, p.EntryBytes)
+		}
+	}
+
+	// Nothing fits a 1 byte DB
+	plans = PlanConfigs(vocab, PlanTarget{DBBytes: 1, BytesPerDoc: 16, D: 1, BatchSize: 32, FailureProbLog2: 8})
+	for _, p := range plans {
+		if p.Fits {
+			t.Errorf("%+v fits a 1 byte DB", p.Config)
+		}
+	}
+}
+
+func TestPlanProbesMatchesBinTerm(t *testing.T) {
+	config := Config{K: 10, D: 2, MaxBins: 7}
+	tokens := []string{"cat", "dog", "cat"}
+
+	choices, err := QueryChoices(nil, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan := PlanProbes(tokens, choices, config.MaxBins)
+
+	// Every bin binTerm puts a token's docs in is probed, and nothing is probed twice
+	seen := make(map[uint64]bool)
+	for _, index := range plan.Indices {
+		if seen[index] {
+			t.Errorf("bin %d probed twice", index)
+		}
+		seen[index] = true
+	}
+	for _, token := range tokens {
+		for _, bin := range binTerm(make(binSets), termHits{word: token, docIDs: []string{"a"}}, config) {
+			if !seen[uint64(bin)] {
+				t.Errorf("%s went into bin %d but it isn't probed", token, bin)
+			}
+		}
+	}
+	sources := 0
+	for i, s := range plan.Sources {
+		sources += len(s)
+		for _, src := range s {
+			if got := hashTokenChoice(tokens[src.Token], src.Choice) % uint64(config.MaxBins); got != plan.Indices[i] {
+				t.Errorf("source %+v hashes to %d, not %d", src, got, plan.Indices[i])
+			}
+		}
+	}
+	if sources != len(tokens)*len(choices) {
+		t.Errorf("%d sources; want %d", sources, len(tokens)*len(choices))
+	}
+
+	// Each token's weight is shared over its choices, so the weights add back up to the tokens'
+	weights := plan.BinWeights([]float64{1, 2, 1})
+	total := 0.0
+	for _, w := range weights {
+		total += w
+	}
+	if math.Abs(total-4) > 1e-9 {
+		t.Errorf("bin weights add up to %g; want 4", total)
+	}
+
+	if _, err := QueryChoices([]uint{3}, config); err == nil {
+		t.Errorf("QueryChoices accepted a choice past D")
+	}
+	if got, err := QueryChoices([]uint{2, 0}, config); err != nil || !reflect.DeepEqual(got, []uint{2, 0}) {
+		t.Errorf("QueryChoices([2 0]) = %v, %v", got, err)
+	}
+}
@@ -0,0 +1,228 @@
+package bins
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// LoadVectors loads the first n rows (all of them for n = 0) of a matrix of dim columns from a .npy, .fvecs, .bvecs,
+// .ivecs or .safetensors file, going by its extension
+func LoadVectors(path string, n int, dim int) (*Matrix, error) {
+	var m *Matrix
+	var err error
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".npy":
+		var h NpyHeader
+		if h, err = ReadNpyHeader(path); err != nil {
+			return nil, err
+		}
+		if len(h.Shape) != 2 || h.Shape[1] != dim {
+			return nil, fmt.Errorf("%s: shape %v, want %d columns", path, h.Shape, dim)
+		}
+		to := -1
+		if n > 0 {
+			to = n
+		}
+		m, err = LoadNpyMatrix(path, 0, to)
+	case ".fvecs", ".bvecs", ".ivecs":
+		m, err = LoadVecs(path, n, dim)
+	case ".safetensors":
+		m, err = LoadSafetensors(path, "", n, dim)
+	default:
+		return nil, fmt.Errorf("%s: unknown vector file extension %q", path, ext)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if m.Dim != dim {
+		return nil, fmt.Errorf("%s: %d columns, want %d", path, m.Dim, dim)
+	}
+	return m, nil
+}
+
+// LoadVecs loads the first n vectors (all of them for n = 0) of the .fvecs (float32), .bvecs (uint8) or .ivecs (int32)
+// files ANN benchmarks use. Every vector is its dimension as a little-endian int32 followed by its components, all
+// little-endian; each has to have dim of them.
+func LoadVecs(path string, n int, dim int) (*Matrix, error) {
+	ext := strings.ToLower(filepath.Ext(path))
+	var size int
+	switch ext {
+	case ".fvecs", ".ivecs":
+		size = 4
+	case ".bvecs":
+		size = 1
+	default:
+		return nil, fmt.Errorf("%s: %q isn't .fvecs, .bvecs or .ivecs", path, ext)
+	}
+	if dim <= 0 {
+		return nil, fmt.Errorf("LoadVecs: dimension %d", dim)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	record := int64(4 + dim*size)
+	if info.Size()%record != 0 {
+		return nil, fmt.Errorf("%s: %d bytes isn't a whole number of %d dimension vectors", path, info.Size(), dim)
+	}
+	rows := int(info.Size() / record)
+	if n > rows {
+		return nil, fmt.Errorf("%s: has %d vectors, want at least %d", path, rows, n)
+	}
+	if n > 0 {
+		rows = n
+	}
+
+	raw, mapping, err := mapRange(path, 0, int64(rows)*record)
+	if err != nil {
+		return nil, err
+	}
+	if mapping != nil {
+		defer unmap(mapping)
+	}
+
+	m := NewMatrix(rows, dim)
+	for i := 0; i < rows; i++ {
+		r := raw[int64(i)*record:]
+		if d := int32(binary.LittleEndian.Uint32(r)); int(d) != dim {
+			return nil, fmt.Errorf("%s: vector %d has dimension %d, want %d", path, i, d, dim)
+		}
+		r = r[4:]
+		row := m.Row(i)
+		for j := range row {
+			switch ext {
+			case ".bvecs":
+				row[j] = float32(r[j])
+			case ".ivecs":
+				row[j] = float32(int32(binary.LittleEndian.Uint32(r[j*4:])))
+			default:
+				row[j] = math.Float32frombits(binary.LittleEndian.Uint32(r[j*4:]))
+			}
+		}
+	}
+	return m, nil
+}
+
+// safetensorsTensor is one entry of a safetensors header
+type safetensorsTensor struct {
+	DType       string  `json:"dtype"`
+	Shape       []int   `json:"shape"`
+	DataOffsets []int64 `json:"data_offsets"` // [begin, end) after the header
+}
+
+// LoadSafetensors loads the first n rows (all of them for n = 0) of the 2-d tensor called name in a safetensors file,
+// or of its only 2-d tensor when name is "". F32 tensors are memory-mapped as they are (see MapFloat32Matrix), F16,
+// BF16 and F64 are converted.
+func LoadSafetensors(path string, name string, n int, dim int) (*Matrix, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	var prefix [8]byte
+	if _, err := io.ReadFull(f, prefix[:]); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: reading safetensors header: %w", path, err)
+	}
+	length := binary.LittleEndian.Uint64(prefix[:])
+	if length > 100<<20 {
+		f.Close()
+		return nil, fmt.Errorf("%s: safetensors header of %d bytes, this probably isn't a safetensors file", path, length)
+	}
+	header := make([]byte, length)
+	_, err = io.ReadFull(f, header)
+	f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("%s: reading safetensors header: %w", path, err)
+	}
+
+	var entries map[string]json.RawMessage
+	if err := json.Unmarshal(header, &entries); err != nil {
+		return nil, fmt.Errorf("%s: safetensors header: %w", path, err)
+	}
+	tensors := make(map[string]safetensorsTensor)
+	for key, raw := range entries {
+		if key == "__metadata__" {
+			continue
+		}
+		var t safetensorsTensor
+		if err := json.Unmarshal(raw, &t); err != nil {
+			return nil, fmt.Errorf("%s: safetensors tensor %s: %w", path, key, err)
+		}
+		tensors[key] = t
+	}
+
+	if name == "" {
+		var matrices []string
+		for key, t := range tensors {
+			if len(t.Shape) == 2 {
+				matrices = append(matrices, key)
+			}
+		}
+		if len(matrices) != 1 {
+			sort.Strings(matrices)
+			return nil, fmt.Errorf("%s: %d 2-d tensors %v, say which one to load", path, len(matrices), matrices)
+		}
+		name = matrices[0]
+	}
+	t, ok := tensors[name]
+	if !ok {
+		return nil, fmt.Errorf("%s: no tensor %q", path, name)
+	}
+	if len(t.Shape) != 2 || t.Shape[1] != dim {
+		return nil, fmt.Errorf("%s: tensor %s has shape %v, want %d columns", path, name, t.Shape, dim)
+	}
+	rows := t.Shape[0]
+	if n > rows {
+		return nil, fmt.Errorf("%s: tensor %s has %d rows, want at least %d", path, name, rows, n)
+	}
+	if n > 0 {
+		rows = n
+	}
+
+	var size int
+	switch t.DType {
+	case "F16", "BF16":
+		size = 2
+	case "F32":
+		size = 4
+	case "F64":
+		size = 8
+	default:
+		return nil, fmt.Errorf("%s: tensor %s is %s, want F16, BF16, F32 or F64", path, name, t.DType)
+	}
+	if len(t.DataOffsets) != 2 || t.DataOffsets[1]-t.DataOffsets[0] != int64(t.Shape[0])*int64(dim)*int64(size) {
+		return nil, fmt.Errorf("%s: tensor %s has data offsets %v for shape %v", path, name, t.DataOffsets, t.Shape)
+	}
+	offset := 8 + int64(length) + t.DataOffsets[0]
+
+	if t.DType == "F32" {
+		return MapFloat32Matrix(path, offset, rows, dim)
+	}
+	raw, mapping, err := mapRange(path, offset, int64(rows)*int64(dim)*int64(size))
+	if err != nil {
+		return nil, err
+	}
+	if mapping != nil {
+		defer unmap(mapping)
+	}
+	m := NewMatrix(rows, dim)
+	for i := range m.Data {
+		switch t.DType {
+		case "F16":
+			m.Data[i] = float16ToFloat32(binary.LittleEndian.Uint16(raw[i*2:]))
+		case "BF16":
+			m.Data[i] = math.Float32frombits(uint32(binary.LittleEndian.Uint16(raw[i*2:])) << 16)
+		case "F64":
+			m.Data[i] = float32(math.Float64frombits(binary.LittleEndian.Uint64(raw[i*8:])))
+		}
+	}
+	return m, nil
+}
@@ -0,0 +1,264 @@
+package bins
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/blugelabs/bluge"
+	"github.com/schollz/progressbar/v3"
+	"github.com/sirupsen/logrus"
+)
+
+// Vocabulary is every term the strict English analyzer produces for a corpus. Terms are kept sorted so the vocabulary
+// has a stable order no matter how it was built, DocFreq[i] is the number of documents containing Terms[i].
+type Vocabulary struct {
+	Terms   []string
+	DocFreq []uint32
+	NumDocs uint64 // documents scanned
+	Tokens  uint64 // total tokens scanned, i.e. the sum of term frequencies
+}
+
+func (v *Vocabulary) Len() int {
+	return len(v.Terms)
+}
+
+// Lookup returns the position of term in the vocabulary
+func (v *Vocabulary) Lookup(term string) (int, bool) {
+	i := sort.SearchStrings(v.Terms, term)
+	if i < len(v.Terms) && v.Terms[i] == term {
+		return i, true
+	}
+	return i, false
+}
+
+// newVocabulary flattens a term -> document frequency map into a sorted Vocabulary
+func newVocabulary(docFreq map[string]uint32) *Vocabulary {
+	v := &Vocabulary{
+		Terms:   make([]string, 0, len(docFreq)),
+		DocFreq: make([]uint32, len(docFreq)),
+	}
+	for term := range docFreq {
+		v.Terms = append(v.Terms, term)
+	}
+	sort.Strings(v.Terms)
+	for i, term := range v.Terms {
+		v.DocFreq[i] = docFreq[term]
+	}
+	return v
+}
+
+// StreamCorpus decodes a BEIR corpus (or an MS MARCO collection TSV, see parseCollectionLine) one line at a time and calls fn for every document, so the corpus never has to
+// fit in memory. As in LoadCorpus, Text falls back to Abstract when it's empty.
+func StreamCorpus(path string, fn func(doc beirDoc) error) error {
+	return streamCorpusWithHash(path, nil, logrus.ErrorLevel, fn)
+}
+
+// streamCorpusWithHash is StreamCorpus that also feeds every byte of the file to h, if it isn't nil, and logs the lines
+// with unknown JSON fields at level
+func streamCorpusWithHash(path string, h hash.Hash, level logrus.Level, fn func(doc beirDoc) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var in io.Reader = f
+	if h != nil {
+		in = io.TeeReader(f, h)
+	}
+
+	br := bufio.NewReader(in)
+	jsonl := isJSONL(br)
+	sc := bufio.NewScanner(br)
+	sc.Buffer(make([]byte, 1024), 10*1024*1024) // max 10 mib, should be fine (I hope)
+	for line := 1; sc.Scan(); line++ {
+		if !jsonl {
+			if len(bytes.TrimSpace(sc.Bytes())) == 0 {
+				continue
+			}
+			d, err := parseCollectionLine(sc.Text())
+			if err != nil {
+				return fmt.Errorf("%s:%d: %w", path, line, err)
+			}
+			if err := fn(d); err != nil {
+				return err
+			}
+			continue
+		}
+		raw := sc.Bytes()
+		dec := json.NewDecoder(bytes.NewReader(raw))
+		dec.DisallowUnknownFields()
+
+		var d beirDoc
+		if err := dec.Decode(&d); err != nil {
+			// if it's an unknown‐field error, log it and continue
+			if strings.HasPrefix(err.Error(), "json: unknown field") {
+				logrus.StandardLogger().Logf(level, "⚠️  unknown JSON field in line: %v", err)
+				logrus.StandardLogger().Logf(level, "Raw JSON line: %s", raw)
+			}
+		}
+
+		body := d.Text
+		if body == "" {
+			body = d.Abstract
+		}
+
+		if err := fn(beirDoc{ID: d.ID, Title: d.Title, Text: body}); err != nil {
+			return err
+		}
+	}
+	return sc.Err()
+}
+
+// ScanVocabulary streams the corpus at path through the strict English analyzer and counts, for every term, how many
+// documents contain it.
+func ScanVocabulary(path string) (*Vocabulary, error) {
+	tokeniser := strictEnglishAnalyzer()
+
+	docFreq := make(map[string]uint32)
+	seen := make(map[string]struct{}) // terms already counted for the current document
+	var numDocs, tokens uint64
+
+	bar := progressbar.Default(-1, "Scanning Vocab for "+path)
+
+	err := StreamCorpus(path, func(doc beirDoc) error {
+		result := doc.Title + " " + doc.Text
+
+		for _, t := range tokeniser.Analyze([]byte(result)) {
+			logrus.Tracef("%q term=%q start=%d end=%d posIncr=%d\n",
+				result[t.Start:t.End], t.Term, t.Start, t.End, t.PositionIncr)
+			tokens++
+			if _, ok := seen[string(t.Term)]; ok {
+				continue
+			}
+			word := string(t.Term)
+			seen[word] = struct{}{}
+			docFreq[word]++
+		}
+		clear(seen)
+
+		numDocs++
+		bar.Add(1)
+		return nil
+	})
+	bar.Finish()
+	if err != nil {
+		return nil, err
+	}
+
+	v := newVocabulary(docFreq)
+	v.NumDocs = numDocs
+	v.Tokens = tokens
+	return v, nil
+}
+
+// VocabularyFromIndex reads the vocabulary out of the term dictionaries of an existing index instead of re-reading the
+// corpus. The index was built with bluge's default analyzer, so every dictionary term is run back through the strict
+// English analyzer. Several index terms can stem to the same word, a document can match in both title and body and
+// bluge's counts are per segment, so DocFreq is only an estimate here. Tokens is left at zero.
+func VocabularyFromIndex(reader *bluge.Reader) (*Vocabulary, error) {
+	tokeniser := strictEnglishAnalyzer()
+
+	numDocs, err := reader.Count()
+	if err != nil {
+		return nil, err
+	}
+
+	docFreq := make(map[string]uint32)
+	for _, field := range []string{"title", "body"} {
+		dict, err := reader.DictionaryIterator(field, nil, nil, nil)
+		if err != nil {
+			return nil, fmt.Errorf("VocabularyFromIndex: field %q: %w", field, err)
+		}
+
+		for {
+			entry, err := dict.Next()
+			if err != nil {
+				dict.Close()
+				return nil, err
+			}
+			if entry == nil {
+				break
+			}
+
+			for _, t := range tokeniser.Analyze([]byte(entry.Term())) {
+				df := uint64(docFreq[string(t.Term)]) + entry.Count()
+				docFreq[string(t.Term)] = uint32(min(df, numDocs))
+			}
+		}
+		dict.Close()
+	}
+
+	v := newVocabulary(docFreq)
+	v.NumDocs = numDocs
+	return v, nil
+}
+
+// WriteVocabulary saves v so later runs (e.g. every shard of a build) can skip the corpus scan
+func WriteVocabulary(path string, v *Vocabulary) error {
+	return writeFileAtomic(path, func(f *os.File) error {
+		return gob.NewEncoder(f).Encode(v)
+	})
+}
+
+// writeFileAtomic writes path through a temp file of its own in the same directory and renames it into place, so
+// readers never see half a file and several processes writing the same path (e.g. every task of a slurm array) can't
+// truncate each other's output: the last rename wins and they all wrote the same thing anyway.
+func writeFileAtomic(path string, write func(f *os.File) error) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	// CreateTemp makes it 0600, os.Create would have given 0644 after the usual umask
+	if err := f.Chmod(0o644); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+func ReadVocabulary(path string) (*Vocabulary, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var v Vocabulary
+	if err := gob.NewDecoder(f).Decode(&v); err != nil {
+		return nil, fmt.Errorf("vocabulary %s: %w", path, err)
+	}
+	if len(v.Terms) != len(v.DocFreq) || !sort.StringsAreSorted(v.Terms) {
+		return nil, fmt.Errorf("vocabulary %s is corrupt", path)
+	}
+	return &v, nil
+}
@@ -0,0 +1,148 @@
+package bins
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/blugelabs/bluge"
+)
+
+func TestScanVocabulary(t *testing.T) {
+	dataset, reader := makeTestDataset(t)
+
+	vocab, err := ScanVocabulary(dataset.OriginalDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vocab.NumDocs != uint64(len(testDocs)) {
+		t.Errorf("NumDocs = %d; want %d", vocab.NumDocs, len(testDocs))
+	}
+
+	// "fox" and "foxes" both stem to fox, the second doc uses it once and the fifth twice
+	i, ok := vocab.Lookup("fox")
+	if !ok {
+		t.Fatalf("fox missing from vocabulary %v", vocab.Terms)
+	}
+	if vocab.DocFreq[i] != 3 {
+		t.Errorf("DocFreq[fox] = %d; want 3", vocab.DocFreq[i])
+	}
+
+	fromIndex, err := VocabularyFromIndex(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the document frequencies from the index are only estimates, but the terms should be the same
+	for _, term := range vocab.Terms {
+		if _, ok := fromIndex.Lookup(term); !ok {
+			t.Errorf("term %q missing from the index vocabulary", term)
+		}
+	}
+}
+
+// Every task of a slurm array may write the same vocabulary at once
+func TestWriteVocabularyConcurrently(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "marco.vocab")
+	want := newVocabulary(map[string]uint32{"fox": 2, "dog": 3})
+
+	var wg sync.WaitGroup
+	errs := make([]error, 8)
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = WriteVocabulary(path, want)
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := ReadVocabulary(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ReadVocabulary = %+v; want %+v", got, want)
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 1 {
+		t.Errorf("%d files left in the directory; want just the vocabulary", len(files))
+	}
+}
+
+func TestMSMARCOFiles(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, text string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(text), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	collection := write("collection.tsv", "0\tThe quick brown fox\n1\tA lazy dog, sleeping\n\n7\t\n")
+	docs, err := LoadCorpus(collection)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []beirDoc{{ID: "0", Text: "The quick brown fox"}, {ID: "1", Text: "A lazy dog, sleeping"}, {ID: "7"}}
+	if !reflect.DeepEqual(docs, want) {
+		t.Errorf("LoadCorpus(collection.tsv) = %+v; want %+v", docs, want)
+	}
+	docs, err = LoadCorpus(write("docs.tsv", "D1\thttp://a\tA title\tThe body\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []beirDoc{{ID: "D1", Title: "A title", Text: "The body"}}; !reflect.DeepEqual(docs, want) {
+		t.Errorf("LoadCorpus(docs.tsv) = %+v; want %+v", docs, want)
+	}
+	if _, err := LoadCorpus(write("bad.tsv", "0 no tabs here\n")); err == nil {
+		t.Error("LoadCorpus took a line without a tab")
+	}
+
+	// indexing goes through the same sniffing
+	indexDir := filepath.Join(dir, "index")
+	LoadBeirJSONL(collection, indexDir)
+	reader, err := bluge.OpenReader(bluge.DefaultConfig(indexDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if n, err := reader.Count(); err != nil || n != 3 {
+		t.Errorf("index has %d docs (%v); want 3", n, err)
+	}
+
+	queries, err := LoadQueries(write("queries.dev.tsv", "1048585\twhat is paula deen's brother\n2\tfox\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []Query{{ID: "1048585", Text: "what is paula deen's brother"}, {ID: "2", Text: "fox"}}; !reflect.DeepEqual(queries, want) {
+		t.Errorf("LoadQueries(queries.dev.tsv) = %+v; want %+v", queries, want)
+	}
+	queries, err = LoadQueries(write("queries.jsonl", "{\"_id\": \"2\", \"text\": \"fox\"}\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queries) != 1 || queries[0].ID != "2" || queries[0].Text != "fox" {
+		t.Errorf("LoadQueries(queries.jsonl) = %+v", queries)
+	}
+
+	trec, err := loadQrels(write("qrels.dev.txt", "1048585\t0\t7187158\t1\n2 0 0 1\n2 0 1 0\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	beir, err := loadQrels(write("test.tsv", "query-id\tcorpus-id\tscore\n1048585\t7187158\t1\n2\t0\t1\n2\t1\t0\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want2 := qrels{"1048585": {"7187158": 1}, "2": {"0": 1}}
+	if !reflect.DeepEqual(trec, want2) || !reflect.DeepEqual(beir, want2) {
+		t.Errorf("loadQrels = %v (TREC), %v (BEIR); want %v", trec, beir, want2)
+	}
+}
@@ -2,17 +2,17 @@
 package main
 
 import (
-	"crypto/sha256"
-	"encoding/binary"
 	"encoding/csv"
 	"encoding/json"
 	"flag"
 	"fmt"
-	"math"
+	"math/rand"
 	"os"
 	"regexp"
 	"runtime"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/blugelabs/bluge"
@@ -34,6 +34,9 @@ const MARCO_SIZE = 8841823
 const DIM = 192
 const RTT = 50
 
+// Piano fails (and answers zeros for) a query with probability 2^-pirFailureProbLog2
+var pirFailureProbLog2 uint64 = 8
+
 func WriteJSON(filename string, data map[string][]string) {
 	f, err := os.Create(filename)
 	if err != nil {
@@ -108,8 +111,76 @@ func main() {
 	// bins.index_stuff()
 
 	//k := flag.Int("k", 100, "MRR@k cutoff")
+	workers := flag.Uint("workers", 0, "goroutines used for the per-term searches when building bins and for encoding the PIR DB (0 = GOMAXPROCS)")
+	vocabFromIndex := flag.Bool("vocab-from-index", false, "read the vocabulary from the index term dictionary instead of streaming the corpus")
+	checkpoint := flag.String("checkpoint", "", "save partial bins to this file while building and resume from it after a restart")
+	checkpointEvery := flag.Uint("checkpoint-every", bins.DefaultCheckpointEvery, "vocabulary terms between checkpoints")
+	mode := flag.String("mode", "build", "build: make the bins then run PIR over them, pir: run PIR over the bins in -bins, "+
+		"hybrid: run PIR over the unigram bins in -bins and the cluster bins in -cluster-bins as one DB, "+
+		"vocab: scan the vocabulary into -vocab and stop, shard: build shard -shard of -shards and write it to -out, "+
+		"merge: merge the shard files given as arguments into -bins, "+
+		"report: write diagnostics about the bins in -bins, plan: suggest a Config that fits -target-db-bytes and -target-client-bytes")
+	binsPath := flag.String("bins", "marco.bins", "bins artifact written by build/merge and read by pir")
+	checkCorpus := flag.Bool("check-corpus", true, "make sure the corpus matches the checksum in the bins artifact before running PIR")
+	vocabPath := flag.String("vocab", "", "vocabulary cache, scanned and written on the first run and reused after")
+	shard := flag.Uint("shard", 0, "shard to build with -mode=shard, e.g. $SLURM_ARRAY_TASK_ID")
+	shards := flag.Uint("shards", 1, "number of shards the vocabulary is split into")
+	out := flag.String("out", "", "partial bins written by -mode=shard (default marco.shard-<shard>-of-<shards>.part)")
+	reportFormat := flag.String("report-format", "json", "json or csv, for -mode=report")
+	reportOut := flag.String("report-out", "", "file the report is written to (default stdout)")
+	payload := flag.String("payload", "vectors", "what PIR entries hold for each doc, vectors: the doc's vector, ids: just its doc ID")
+	quantize := flag.String("quantize", "float32", "how vectors are stored in PIR entries: float32, float16, int8 or pq "+
+		"(int8 and pq are fitted to -vectors when the bins are built)")
+	pqSubspaces := flag.Uint("pq-subspaces", 24, "PQ subspaces, i.e. bytes per doc, for -quantize=pq (has to divide the vector dims)")
+	pqCodebook := flag.String("pq-codebook", "marco.pq", "PQ codebook the client needs, trained and written when -quantize=pq bins are built")
+	evalQuantization := flag.Bool("eval-quantization", false, "report the recall and rerank score impact of -quantize before running PIR "+
+		"(a pass over every vector that keeps a hash of each one's code)")
+	binning := flag.String("binning", "unigram", "unigram: bins of each term's BM25 top-K, kmeans: k-means clusters of the doc vectors")
+	clusters := flag.Uint("clusters", 4096, "clusters (bins) for -binning=kmeans")
+	clusterAssign := flag.Uint("cluster-assign", 1, "nearest clusters each doc goes into for -binning=kmeans")
+	nprobe := flag.Int("nprobe", 8, "nearest clusters the client queries for -binning=kmeans")
+	centroidsPath := flag.String("centroids", "marco.centroids.npy", "cluster centroids published to the client, written by -binning=kmeans builds")
+	clusterBinsPath := flag.String("cluster-bins", "marco.clusters.bins", "-binning=kmeans bins artifact, for -mode=hybrid")
+	vectorsPath := flag.String("vectors", "", "doc vectors, one row per doc as -vector-ids says: .npy, .fvecs, .bvecs, .ivecs or "+
+		".safetensors (default <datasets>/Son/my_vectors_192.npy)")
+	vectorIDs := flag.String("vector-ids", "", "_id of each -vectors row, one per line (default <vectors>.id if there is one, "+
+		"otherwise row i is _id i)")
+	queryVectors := flag.String("query-vectors", "", ".npy of query embeddings, one row per query in the queries file, for -binning=kmeans and reranking")
+	projection := flag.String("projection", "", "vocabulary x dimension .npy (term embeddings or PCA/SVD components) the client "+
+		"embeds queries with when there's no -query-vectors")
+	projectionTerms := flag.String("projection-terms", "", "terms of the -projection rows, one per line (default the -vocab terms, in order)")
+	choicesFlag := flag.String("choices", "", "comma-separated hash choices the client probes for each token (default all of 0..D)")
+	rerank := flag.String("rerank", "auto", "how the client ranks the docs it decoded: none, dot, cosine, bm25, rrf, or auto "+
+		"(dot when it has doc vectors and -query-vectors, bm25 otherwise)")
+	rowSizeFlag := flag.Int("row-size", 0, "docs per PIR row, bigger bins span a run of rows (0 = the mean non-empty bin size)")
+	tiers := flag.Int("tiers", 0, "split the bins into up to this many size tiers, each its own PIR DB padded to its largest bin "+
+		"(0 = one DB of -row-size rows)")
+	tierQueries := flag.Int("tier-queries", 32, "sub-queries every query sends to every tier with -tiers, bins past it are dropped")
+	topK := flag.Int("top-k", 100, "docs kept per query in results.json (0 = all)")
+	evalK := flag.Int("eval-k", 10, "cutoff for the MRR and nDCG of results.json against the qrels")
+	targetDBBytes := flag.Uint64("target-db-bytes", 0, "largest rawDB -mode=plan may suggest, in bytes (0 = no limit)")
+	targetClientBytes := flag.Uint64("target-client-bytes", 0, "largest client hint storage -mode=plan may suggest, in bytes (0 = no limit)")
+	corpusPath := flag.String("corpus", root+"/msmarco/corpus.jsonl", "BEIR corpus.jsonl or MS MARCO collection.tsv")
+	queriesPath := flag.String("queries", root+"/msmarco/queries.jsonl", "BEIR queries.jsonl or MS MARCO queries.*.tsv")
+	qrelsPath := flag.String("qrels", root+"/msmarco/qrels/test.tsv", "BEIR qrels .tsv or TREC style qrels, e.g. MS MARCO's qrels.*.txt")
 	flag.Parse()
 
+	var filenames bool
+	switch *payload {
+	case "vectors":
+	case "ids":
+		filenames = true
+	default:
+		logrus.Fatalf("Unknown -payload %q", *payload)
+	}
+	encoding, err := bins.ParseVectorEncoding(*quantize)
+	bins.Must(err)
+	binningKind, err := bins.ParseBinning(*binning)
+	bins.Must(err)
+	if *clusterAssign == 0 {
+		logrus.Fatalf("-cluster-assign has to be at least 1")
+	}
+
 	datasets := []bins.DatasetMetadata{
 		//{
 		//	"SciFact",
@@ -126,11 +197,11 @@ func main() {
 		//	root + "/trec-covid/qrels/test.tsv",
 		//},
 		{
-			"Marco",
-			"index_marco",
-			root + "/msmarco/corpus.jsonl",
-			root + "/msmarco/queries.jsonl",
-			root + "/msmarco/qrels/test.tsv",
+			Name:        "Marco",
+			IndexDir:    "index_marco",
+			OriginalDir: *corpusPath,
+			Queries:     *queriesPath,
+			Qrels:       *qrelsPath,
 		},
 	}
 
@@ -141,40 +212,194 @@ func main() {
 		//fmt.Printf("k = %d\n\n", *k)
 		//fmt.Printf("%-10s : MRR@%d = %.5f\n", d.name, *k, mrr)
 
-		// Grab the data in normalised size bytes:
-
-		bm25Vectors, err := bins.LoadFloat32MatrixFromNpy(root+"/Son/my_vectors_192.npy", MARCO_SIZE, DIM)
-		//bm25Vectors, err := bins.LoadFloat32MatrixFromNpy("my_vector_reduced.npy", MARCO_SIZE, DIM)
-		bins.Must(err)
-
-		logrus.Infof("Size of vectors: %d", len(bm25Vectors))
-
-		reader, _ := bluge.OpenReader(bluge.DefaultConfig(d.IndexDir))
-		defer reader.Close()
 		k := uint(100)
 		config := bins.Config{
 			K:         k,
 			D:         1,
 			MaxBins:   MARCO_SIZE / 100,
+			Filenames: filenames,
 			Threshold: k / 10,
+			Encoding:  encoding,
+			Subspaces: *pqSubspaces,
+			Workers:   *workers,
+
+			Checkpoint:      *checkpoint,
+			CheckpointEvery: *checkpointEvery,
+		}
+		clusterConfig := config
+		clusterConfig.Binning = bins.BinKMeans
+		clusterConfig.K, clusterConfig.Threshold = 0, 0
+		clusterConfig.D = *clusterAssign - 1
+		clusterConfig.MaxBins = *clusters
+
+		if binningKind == bins.BinKMeans {
+			config = clusterConfig
+
+			switch *mode {
+			case "vocab", "shard", "merge", "plan", "hybrid":
+				logrus.Fatalf("-mode=%s only works with -binning=unigram", *mode)
+			}
 		}
-		var DB = bins.MakeUnigramDB(reader, d, config)
-		err = WriteCSV("marco.csv", DB)
-		bins.Must(err)
 
-		//DB, err := ReadCSV("debug_marco.csv")
-		//bins.Must(err)
+		var art, clusterArt *bins.BinsArtifact
+		var bm25Vectors *bins.Matrix
+		var docRows *bins.DocRows
+		var centroids [][]float32
+		switch *mode {
+		case "build":
+			if config.Binning == bins.BinKMeans {
+				bm25Vectors, docRows = loadVectors(*vectorsPath, *vectorIDs, root)
+
+				DB, c, stats, err := bins.MakeClusterDB(bm25Vectors.RowViews(), docRows.IDs(), config, bins.ClusterTraining{
+					Sample: clusterTrainSample, Iters: clusterIters, Seed: 1,
+				})
+				bins.Must(err)
+				centroids = c
+				bins.Must(bins.WriteFloat32Npy(*centroidsPath, centroids))
+				logrus.Infof("Wrote %d centroids to %s", len(centroids), *centroidsPath)
+				art = writeBins(*binsPath, DB, stats, d, config, centroids, fitQuantizer(bm25Vectors, *pqCodebook, config))
+				break
+			}
+
+			reader, err := bluge.OpenReader(bluge.DefaultConfig(d.IndexDir))
+			bins.Must(err)
+			vocab := loadVocabulary(*vocabPath, *vocabFromIndex, reader, d)
+
+			DB, stats := bins.MakeUnigramDBFromVocabulary(reader, vocab, d, config)
+			reader.Close()
+			if needsQuantizer(config) {
+				bm25Vectors, docRows = loadVectors(*vectorsPath, *vectorIDs, root)
+			}
+			art = writeBins(*binsPath, DB, stats, d, config, nil, fitQuantizer(bm25Vectors, *pqCodebook, config))
 
-		// main.go, right after ReadCSV("marco.csv")
-		nonEmpty, empty := 0, 0
-		for i := range DB {
-			if len(DB[i]) == 0 {
-				empty++
-			} else {
-				nonEmpty++
+		case "pir":
+			checksum := corpusChecksum(d, *checkCorpus)
+			art = readBins(*binsPath, d.Name, config, checksum)
+			if config.Binning == bins.BinKMeans {
+				centroids = loadCentroids(*centroidsPath, art)
 			}
+
+		case "hybrid":
+			checksum := corpusChecksum(d, *checkCorpus)
+			art = readBins(*binsPath, d.Name, config, checksum)
+			clusterArt = readBins(*clusterBinsPath, d.Name, clusterConfig, checksum)
+			centroids = loadCentroids(*centroidsPath, clusterArt)
+
+		case "vocab":
+			if *vocabPath == "" {
+				logrus.Fatalf("-mode=vocab needs -vocab")
+			}
+			reader, err := bluge.OpenReader(bluge.DefaultConfig(d.IndexDir))
+			bins.Must(err)
+			loadVocabulary(*vocabPath, *vocabFromIndex, reader, d)
+			reader.Close()
+			continue
+
+		case "shard":
+			if *shard >= *shards {
+				logrus.Fatalf("-shard %d out of range for -shards %d", *shard, *shards)
+			}
+			if config.Checkpoint != "" && *shards > 1 {
+				config.Checkpoint = fmt.Sprintf("%s.shard-%d", config.Checkpoint, *shard)
+			}
+			path := *out
+			if path == "" {
+				path = fmt.Sprintf("marco.shard-%d-of-%d.part", *shard, *shards)
+			}
+
+			reader, err := bluge.OpenReader(bluge.DefaultConfig(d.IndexDir))
+			bins.Must(err)
+			vocab := loadVocabulary(*vocabPath, *vocabFromIndex, reader, d)
+
+			part := bins.MakeUnigramShard(reader, vocab, d, config, *shard, *shards)
+			reader.Close()
+			bins.Must(bins.WritePartialBins(path, part))
+			logrus.Infof("Wrote shard %d/%d (terms [%d, %d)) to %s", *shard, *shards, part.Start, part.End, path)
+			continue
+
+		case "merge":
+			parts := make([]*bins.PartialBins, 0, flag.NArg())
+			for _, path := range flag.Args() {
+				part, err := bins.ReadPartialBins(path)
+				bins.Must(err)
+				parts = append(parts, part)
+			}
+			merged, stats, err := bins.MergePartialBins(parts)
+			bins.Must(err)
+			var quantizer *bins.Quantizer
+			if needsQuantizer(parts[0].Config) {
+				vectors, _ := loadVectors(*vectorsPath, *vectorIDs, root)
+				quantizer = fitQuantizer(vectors, *pqCodebook, parts[0].Config)
+			}
+			writeBins(*binsPath, merged, stats, d, parts[0].Config, nil, quantizer)
+			logrus.Infof("Merged %d shards into %s", len(parts), *binsPath)
+			continue
+
+		case "report":
+			art, err := bins.ReadBinsArtifact(*binsPath)
+			bins.Must(err)
+			reportTiers := *tiers
+			if reportTiers == 0 {
+				reportTiers = bins.DefaultTiers
+			}
+			writeReport(bins.NewBinsReport(art, bytesPerDoc(config), reportTiers), *reportFormat, *reportOut)
+			continue
+
+		case "plan":
+			reader, err := bluge.OpenReader(bluge.DefaultConfig(d.IndexDir))
+			bins.Must(err)
+			vocab := loadVocabulary(*vocabPath, *vocabFromIndex, reader, d)
+			reader.Close()
+
+			plans := bins.PlanConfigs(vocab, bins.PlanTarget{
+				DBBytes:         *targetDBBytes,
+				ClientBytes:     *targetClientBytes,
+				BytesPerDoc:     bytesPerDoc(config),
+				D:               config.D,
+				BatchSize:       32,
+				FailureProbLog2: 8,
+			})
+			bins.Must(bins.PrintPlans(os.Stdout, plans))
+			if len(plans) == 0 || !plans[0].Fits {
+				logrus.Warnf("No config fits the target")
+				continue
+			}
+			best := plans[0]
+			logrus.Infof("Recommended: K=%d D=%d MaxBins=%d Threshold=%d -row-size=%d, max_row_size <= %d, rawDB ~%d bytes",
+				best.Config.K, best.Config.D, best.Config.MaxBins, best.Config.Threshold, best.RowSize, best.MaxRowSize, best.RawDBBytes)
+			continue
+
+		default:
+			logrus.Fatalf("Unknown -mode %q", *mode)
 		}
-		logrus.Infof("CSV bins: non-empty=%d empty=%d total=%d", nonEmpty, empty, len(DB))
+
+		// Grab the data in normalised size bytes:
+
+		// Doc ID entries don't need the vectors at all
+		if config.Payload() == bins.PayloadVectors {
+			if bm25Vectors == nil {
+				bm25Vectors, docRows = loadVectors(*vectorsPath, *vectorIDs, root)
+			}
+		} else {
+			bm25Vectors, docRows = nil, nil
+		}
+		quantizer := loadQuantizer(art, *pqCodebook, bm25Vectors, config, *evalQuantization)
+
+		// The quantizer lives in the lexical artifact, so the hybrid table is only put together after loading it
+		var layout bins.HybridLayout
+		if clusterArt != nil {
+			var err error
+			art, layout, err = bins.NewHybridArtifact(art, clusterArt)
+			bins.Must(err)
+			logrus.Infof("Hybrid DB: lexical bins [0, %d), cluster bins [%d, %d)", layout.LexicalBins,
+				layout.LexicalBins, layout.LexicalBins+layout.ClusterBins)
+		}
+
+		//DB, err := ReadCSV("debug_marco.csv")
+		//bins.Must(err)
+
+		nonEmpty := art.NonEmpty()
+		logrus.Infof("Bins: non-empty=%d empty=%d total=%d", nonEmpty, len(art.Bins)-nonEmpty, len(art.Bins))
 
 		//
 		//if len(DB) != len(DB_2) {
@@ -195,8 +420,6 @@ func main() {
 		//the encoder expects a more traditional DB, i.e. a single index to a single entry. As a 'hack' I'm going to
 		// change the index's of bins into a string seperated by "--!--" and just encode and decode on the client/server
 
-		// TODO: Something with .npy.id file
-
 		//TODO Remove this debug sampling
 		//const sampleRows = 300
 		//const sampleCols = 20
@@ -205,19 +428,160 @@ func main() {
 		//	DB = DB[:sampleRows]
 		//}
 
-		answers := doPIR(DB, bm25Vectors, d)
+		// The client needs the document frequencies for BM25 weights and projecting queries
+		var vocab *bins.Vocabulary
+		getVocab := func() *bins.Vocabulary {
+			if vocab == nil {
+				reader, err := bluge.OpenReader(bluge.DefaultConfig(d.IndexDir))
+				bins.Must(err)
+				vocab = loadVocabulary(*vocabPath, *vocabFromIndex, reader, d)
+				reader.Close()
+			}
+			return vocab
+		}
+
+		var queryEmbeddings [][]float32
+		switch {
+		case *queryVectors != "":
+			queryEmbeddings, err = bins.LoadFloat32Npy(*queryVectors)
+			bins.Must(err)
+		case *projection != "":
+			queryEmbeddings = embedQueries(*projection, *projectionTerms, getVocab(), d)
+		}
+		embedding := func(i int) []float32 {
+			if i >= len(queryEmbeddings) {
+				logrus.Fatalf("%s has %d rows, but there are more queries", *queryVectors, len(queryEmbeddings))
+			}
+			return queryEmbeddings[i]
+		}
+
+		choices, err := bins.QueryChoices(parseChoices(*choicesFlag), config)
+		bins.Must(err)
+		lexicalModulus := uint(len(art.Bins))
+		if clusterArt != nil {
+			lexicalModulus = uint(layout.LexicalBins)
+		}
+
+		search := func(i int, q bins.Query, binsDB PIRBins) [][]uint64 {
+			return BinSearch(q, choices, binsDB)
+		}
+		if config.Binning == bins.BinKMeans || clusterArt != nil {
+			if queryEmbeddings == nil {
+				logrus.Fatalf("-binning=kmeans and -mode=hybrid need -query-vectors or -projection")
+			}
+
+			search = func(i int, q bins.Query, binsDB PIRBins) [][]uint64 {
+				return ClusterSearch(embedding(i), centroids, *nprobe, binsDB)
+			}
+			if clusterArt != nil {
+				search = func(i int, q bins.Query, binsDB PIRBins) [][]uint64 {
+					return HybridSearch(q, choices, embedding(i), centroids, *nprobe, layout, binsDB)
+				}
+			}
+		}
+
+		method := bins.RerankBM25
+		if *rerank == "auto" {
+			if bm25Vectors != nil && queryEmbeddings != nil {
+				method = bins.RerankDot
+			}
+		} else {
+			method, err = bins.ParseRerankMethod(*rerank)
+			bins.Must(err)
+		}
+		if method.NeedsVectors() && (bm25Vectors == nil || queryEmbeddings == nil) {
+			logrus.Fatalf("-rerank=%v needs -payload=vectors and -query-vectors or -projection", method)
+		}
+
+		// BM25 weights each token bin by the term's IDF
+		var weights *bins.Vocabulary
+		if (method == bins.RerankBM25 || method == bins.RerankRRF) && config.Binning == bins.BinUnigram {
+			weights = getVocab()
+		}
+
+		rowSize := *rowSizeFlag
+		if rowSize == 0 {
+			rowSize = bins.AutoRowSize(art)
+		}
+		preprocessWorkers := int(*workers)
+		if preprocessWorkers == 0 {
+			preprocessWorkers = runtime.GOMAXPROCS(0)
+		}
+		answers := doPIR(art, bm25Vectors, docRows, quantizer, d, config.Payload(), rowSize, *tiers, *tierQueries, preprocessWorkers, search)
 
 		logrus.Debugf("Number of answers: %d", len(answers))
 
-		// Make a map for rapid lookup later:
-		IDLookup := make(map[string]int)
+		// Every slot carries its doc index, so the client only needs the doc dictionary, not the corpus vectors
+		codec := bins.EntryCodec{Payload: config.Payload(), Quantizer: quantizer}
+		if *tiers == 0 {
+			codec.RowWords = codec.EntryWords(rowSize)
+		}
+		decode := func(entries [][]uint64) (bins.Retrieved, error) {
+			return bins.DecodeBins(entries, art.DocIDs, codec)
+		}
+
+		// Decode and rank one query at a time, so only one query's decoded vectors are ever held
+		queries, err := bins.LoadQueries(d.Queries)
+		bins.Must(err)
+		qidsToDocids := make(map[string][]string, len(answers))
+		for i, q := range queries {
+			entries, ok := answers[q.ID]
+			if !ok {
+				continue
+			}
+			// The lexical probes are deterministic, so the client can work out which token and choice each bin was for
+			split := len(entries)
+			var plan bins.ProbePlan
+			if config.Binning == bins.BinUnigram {
+				terms := query_terms(q.Text)
+				plan = bins.PlanProbes(terms, choices, lexicalModulus)
+				split = len(plan.Indices)
+			}
+
+			retrieved, err := decode(entries[:split])
+			bins.Must(err)
+			if config.Binning == bins.BinUnigram {
+				var idfs []float64
+				if weights != nil {
+					for _, term := range query_terms(q.Text) {
+						idfs = append(idfs, bins.IDF(weights, term))
+					}
+				}
+				retrieved.Weights = plan.BinWeights(idfs)
+			}
+
+			if clusterArt != nil {
+				cluster, err := decode(entries[split:])
+				bins.Must(err)
+				if method == bins.RerankNone {
+					qidsToDocids[q.ID] = bins.FuseHybridQuery(retrieved.Docs(), cluster.Docs(), split, len(entries)-split)
+					if *topK > 0 && len(qidsToDocids[q.ID]) > *topK {
+						qidsToDocids[q.ID] = qidsToDocids[q.ID][:*topK]
+					}
+					continue
+				}
+
+				// Cluster bins aren't lexical evidence, so they add nothing to the BM25 score
+				retrieved.Bins = append(retrieved.Bins, cluster.Bins...)
+				retrieved.Weights = append(retrieved.Weights, make([]float64, len(cluster.Bins))...)
+				for doc, v := range cluster.Vectors {
+					retrieved.Vectors[doc] = v
+				}
+			}
 
-		for i := 0; i < len(bm25Vectors); i++ {
-			ID := bins.HashFloat32s(bm25Vectors[i])
-			IDLookup[ID] = i
+			var query []float32
+			if queryEmbeddings != nil {
+				query = embedding(i)
+			}
+			qidsToDocids[q.ID], err = bins.Rerank(method, query, retrieved, *topK)
+			bins.Must(err)
 		}
 
-		qidsToDocids := bins.FromEmbedToID(answers, IDLookup, DIM)
+		if _, err := os.Stat(d.Qrels); err == nil {
+			m, err := bins.EvaluateRun(qidsToDocids, d.Qrels, *evalK)
+			bins.Must(err)
+			logrus.Infof("Rerank %v over %d judged queries: MRR@%d=%.4f nDCG@%d=%.4f", method, m.Queries, m.K, m.MRR, m.K, m.NDCG)
+		}
 
 		WriteJSON("results.json", qidsToDocids)
 
@@ -225,64 +589,327 @@ func main() {
 
 }
 
-// ---- PIR stuff
+// corpusChecksum is the corpus checksum to check bins artifacts against, or "" to skip the check
+func corpusChecksum(d bins.DatasetMetadata, check bool) string {
+	if !check {
+		return ""
+	}
+	checksum, err := bins.CorpusChecksum(d.OriginalDir)
+	bins.Must(err)
+	return checksum
+}
 
-func doPIR(DB [][]string, bm25Vectors [][]float32, d bins.DatasetMetadata) map[string][][]uint64 {
+// readBins reads the bins artifact at path and makes sure it was built for dataset with config from the corpus with
+// checksum
+func readBins(path string, dataset string, config bins.Config, checksum string) *bins.BinsArtifact {
+	art, err := bins.ReadBinsArtifact(path)
+	bins.Must(err)
+	bins.Must(art.Check(dataset, config, checksum))
+	return art
+}
 
-	pad := make([]float32, DIM) // zeros; or fill with 1s once if you need
-	max_row_size := 0
-	redundancy := 0
-	for _, e := range DB {
-		if len(e) > max_row_size {
-			max_row_size = len(e)
+// loadCentroids reads the centroids the client probes cluster bins with, they have to be the ones art was built from
+func loadCentroids(path string, art *bins.BinsArtifact) [][]float32 {
+	centroids, err := bins.LoadFloat32Npy(path)
+	bins.Must(err)
+	if sum := bins.CentroidsChecksum(centroids); sum != art.Header.Centroids {
+		logrus.Fatalf("%s aren't the centroids the bins were built from", path)
+	}
+	return centroids
+}
+
+// embedQueries projects every query into the doc vector space with the projection matrix at path, weighting its tokens by
+// their IDF. Row i is the embedding of the i'th query in the queries file, like -query-vectors.
+func embedQueries(path string, termsPath string, vocab *bins.Vocabulary, d bins.DatasetMetadata) [][]float32 {
+	p, err := bins.LoadProjection(path, termsPath, vocab)
+	bins.Must(err)
+	if p.Dim() != DIM {
+		logrus.Fatalf("%s projects to %d dims but the doc vectors have %d", path, p.Dim(), DIM)
+	}
+
+	queries, err := bins.LoadQueries(d.Queries)
+	bins.Must(err)
+	idf := func(term string) float64 { return bins.IDF(vocab, term) }
+	embeddings := make([][]float32, len(queries))
+	for i, q := range queries {
+		embeddings[i] = p.Embed(query_terms(q.Text), idf)
+	}
+	logrus.Infof("Embedded %d queries with the %dx%d projection %s", len(queries), len(p.Terms), p.Dim(), path)
+	return embeddings
+}
+
+// loadVectors loads every doc vector in path (the MS MARCO vectors under root if it's empty), along with which _id each
+// row is from idsPath (see bins.VectorIDsPath). Only docs in the bins need a vector, doPIR checks they all have one.
+func loadVectors(path string, idsPath string, root string) (*bins.Matrix, *bins.DocRows) {
+	if path == "" {
+		path = root + "/Son/my_vectors_192.npy"
+	}
+	bm25Vectors, err := bins.LoadVectors(path, 0, DIM)
+	//bm25Vectors, err := bins.LoadFloat32MatrixFromNpy("my_vector_reduced.npy", MARCO_SIZE, DIM)
+	bins.Must(err)
+	logrus.Infof("Size of vectors: %d", bm25Vectors.Rows)
+
+	if idsPath == "" {
+		if _, err := os.Stat(bins.VectorIDsPath(path)); err != nil {
+			logrus.Infof("No %s, taking row i of the vectors to be _id i", bins.VectorIDsPath(path))
+			return bm25Vectors, bins.IdentityDocRows(bm25Vectors.Rows)
 		}
+		idsPath = bins.VectorIDsPath(path)
 	}
-	//if max_row_size > sampleCols {
-	//	max_row_size = sampleCols
-	//}
+	docRows, err := bins.LoadDocRows(idsPath, bm25Vectors.Rows)
+	bins.Must(err)
+	logrus.Infof("Read the _ids of the vectors from %s", idsPath)
+	return bm25Vectors, docRows
+}
 
-	new_DB := make([][][]float32, 0, len(DB))
-	for _, entry := range DB {
-		row := make([][]float32, 0, max_row_size)
-		// cap columns
-		upto := len(entry)
-		if upto > max_row_size { // This does nothing??
-			logrus.Warnf("Row exceeded the maximum row size!!")
-			upto = max_row_size
+// loadVocabulary reads the vocabulary cache at path if there is one, otherwise it scans the vocabulary (from the corpus,
+// or the index with fromIndex) and writes it to path for the next run
+func loadVocabulary(path string, fromIndex bool, reader *bluge.Reader, d bins.DatasetMetadata) *bins.Vocabulary {
+	if path != "" {
+		vocab, err := bins.ReadVocabulary(path)
+		if err == nil {
+			logrus.Infof("Loaded %d terms from %s", vocab.Len(), path)
+			return vocab
+		}
+		if !os.IsNotExist(err) {
+			bins.Must(err)
+		}
+	}
+
+	var vocab *bins.Vocabulary
+	var err error
+	if fromIndex {
+		vocab, err = bins.VocabularyFromIndex(reader)
+	} else {
+		vocab, err = bins.ScanVocabulary(d.OriginalDir)
+	}
+	bins.Must(err)
+
+	if path != "" {
+		bins.Must(bins.WriteVocabulary(path, vocab))
+	}
+	return vocab
+}
+
+// writeBins turns a bin table into a bins artifact over the corpus doc IDs and writes it to path. centroids are the
+// BinKMeans centroids, nil for unigram bins.
+func writeBins(path string, DB [][]string, stats bins.BuildStats, d bins.DatasetMetadata, config bins.Config, centroids [][]float32,
+	quantizer *bins.Quantizer) *bins.BinsArtifact {
+	docIDs, checksum, err := bins.ScanCorpusIDs(d.OriginalDir)
+	bins.Must(err)
+
+	art, err := bins.NewBinsArtifact(DB, stats, docIDs, d.Name, checksum, config)
+	bins.Must(err)
+	if centroids != nil {
+		art.Header.Centroids = bins.CentroidsChecksum(centroids)
+	}
+	art.Header.Quantizer = quantizer
+	bins.Must(bins.WriteBinsArtifact(path, art))
+	logrus.Infof("Wrote %d bins over %d docs to %s", len(art.Bins), len(art.DocIDs), path)
+
+	return art
+}
+
+func writeReport(report *bins.BinsReport, format string, path string) {
+	w := os.Stdout
+	if path != "" {
+		f, err := os.Create(path)
+		bins.Must(err)
+		defer f.Close()
+		w = f
+	}
+
+	switch format {
+	case "json":
+		bins.Must(report.WriteJSON(w))
+	case "csv":
+		bins.Must(report.WriteCSV(w))
+	default:
+		logrus.Fatalf("Unknown -report-format %q", format)
+	}
+}
+
+// bytesPerDoc is how much of a PIR entry one doc takes up
+func bytesPerDoc(config bins.Config) int {
+	if config.Payload() == bins.PayloadDocIDs {
+		return bins.DocIDBytes
+	}
+	if config.Encoding == bins.EncodingPQ {
+		return bins.DocIDBytes + int(config.Subspaces)
+	}
+	return bins.DocIDBytes + DIM*config.Encoding.BytesPerDim()
+}
+
+// k-means training for -binning=kmeans, the centroids are trained on a sample of the vectors
+const (
+	clusterTrainSample = 500000
+	clusterIters       = 20
+)
+
+// PQ training, the codebook is trained on a sample of the vectors
+const (
+	pqCentroids   = bins.MaxPQCentroids
+	pqTrainSample = 100000
+	pqIters       = 25
+)
+
+// needsQuantizer says whether bins built with config have to be built along with a quantizer fitted to the vectors
+func needsQuantizer(config bins.Config) bool {
+	return config.Payload() == bins.PayloadVectors && config.Encoding.Fitted()
+}
+
+// fitQuantizer fits the quantizer for config.Encoding to the vectors as the bins are built, so it goes into their
+// artifact header along with the checksum of the vectors. PQ codebooks are trained and written to codebookPath, the
+// quantizer only keeps their checksum. Encodings that don't need fitting get nil.
+func fitQuantizer(vectors *bins.Matrix, codebookPath string, config bins.Config) *bins.Quantizer {
+	if !needsQuantizer(config) {
+		return nil
+	}
+
+	var quantizer *bins.Quantizer
+	switch config.Encoding {
+	case bins.EncodingPQ:
+		start := time.Now()
+		codebook, err := bins.TrainPQ(vectors.RowViews(), DIM, int(config.Subspaces), pqCentroids, pqTrainSample, pqIters, 1)
+		bins.Must(err)
+		bins.Must(bins.WritePQCodebook(codebookPath, codebook))
+		logrus.Infof("Trained a %dx%d PQ codebook in %v and wrote it to %s", config.Subspaces, pqCentroids,
+			time.Since(start), codebookPath)
+		quantizer = bins.NewPQQuantizer(codebook)
+	default:
+		quantizer = bins.FitQuantizer(vectors.RowViews(), DIM, config.Encoding)
+		logrus.Infof("Fitted a %v quantizer", config.Encoding)
+	}
+	quantizer.Vectors = vectors.Checksum()
+	return quantizer
+}
+
+// loadQuantizer returns the quantizer the bins artifact was built with for config.Encoding, so the client always
+// decodes with the scales the entries were encoded with. It has to have been fitted to these vectors, and for PQ the
+// codebook at codebookPath has to be the one it was trained as. Encodings that don't need fitting don't need the
+// artifact to have one, doc ID payloads don't load any vectors and get nil.
+func loadQuantizer(art *bins.BinsArtifact, codebookPath string, vectors *bins.Matrix, config bins.Config, evaluate bool) *bins.Quantizer {
+	if vectors == nil {
+		return nil
+	}
+	encoding := config.Encoding
+
+	quantizer := bins.FitQuantizer(nil, DIM, encoding)
+	if encoding.Fitted() {
+		quantizer = art.Header.Quantizer
+		if quantizer == nil || quantizer.Encoding != encoding || quantizer.Dim != DIM ||
+			(encoding == bins.EncodingPQ && quantizer.Subspaces != int(config.Subspaces)) {
+			logrus.Fatalf("The bins weren't built with -quantize=%v (-pq-subspaces=%d) over %d dims, rebuild them with it",
+				encoding, config.Subspaces, DIM)
+		}
+		if quantizer.Vectors != vectors.Checksum() {
+			logrus.Fatalf("The bins' %v quantizer was fitted to other vectors than -vectors, rebuild them with these", encoding)
 		}
-		for j := 0; j < upto; j++ {
-			id64, err := strconv.ParseUint(entry[j], 10, 32)
+		if encoding == bins.EncodingPQ {
+			codebook, err := bins.ReadPQCodebook(codebookPath)
 			bins.Must(err)
-			//TODO REMOVE ONCE DONE DEBUGGING!
-			// id64 = id64 % MARCO_SIZE
-			row = append(row, bm25Vectors[id64]) // shares the row slice; no copy
+			bins.Must(quantizer.AttachCodebook(codebook))
 		}
-		for len(row) < max_row_size {
-			redundancy++
-			row = append(row, pad) // shared, no per-cell alloc
+	}
+
+	if evaluate && encoding != bins.EncodingFloat32 {
+		r, err := bins.EvaluateQuantizer(quantizer, vectors.RowViews(), 100, 100000, 10, 1)
+		bins.Must(err)
+		logrus.Infof("Quantization %v: %d bytes per doc (float32 %d), MSE=%.3g max abs error=%.3g",
+			r.Encoding, r.BytesPerDoc, DIM*4, r.MSE, r.MaxAbsError)
+		logrus.Infof("Quantization %v: neighbour recall@%d=%.4f over %d queries x %d candidates, mean rerank score error=%.3g",
+			r.Encoding, r.K, r.RecallAtK, r.Queries, r.Candidates, r.ScoreError)
+		if r.Collisions > 0 {
+			logrus.Warnf("Quantization %v: %d vectors decode the same as another one, reranking can't tell them apart",
+				r.Encoding, r.Collisions)
 		}
-		new_DB = append(new_DB, row)
 	}
-	//bm_25_vectors = nil
-	DB = nil
 
-	runtime.GC()
+	return quantizer
+}
 
-	// main.go, after new_DB & before Preprocess(...)
-	wordsPerEntry := (uint64(DIM) * 4 * uint64(max_row_size)) / 8
-	logrus.Infof("Row layout: DIM=%d, max_row_size=%d, wordsPerEntry=%d", DIM, max_row_size, wordsPerEntry)
+// ---- PIR stuff
 
-	b := uint64(len(new_DB)) * uint64(max_row_size) * uint64(DIM) * 4
-	logrus.Infof("New DB size: %.2f MiB (%d bytes)", float64(b)/(1<<20), b)
+// doPIR sets up PIR over the bins and answers every query, search turns the i'th query into PIR queries (BinSearch or
+// ClusterSearch). Each bin is stored as a run of PIR rows of rowSize docs (see bins.RowLayout) and its answer is the
+// run's rows back to back, or with tiers > 0 the bins are split into that many size tiers (see bins.TierLayout), each
+// its own PIR DB that every query sends tierQueries sub-queries to. The entries are encoded by workers goroutines.
+func doPIR(art *bins.BinsArtifact, bm25Vectors *bins.Matrix, docRows *bins.DocRows, quantizer *bins.Quantizer, d bins.DatasetMetadata, payload bins.Payload,
+	rowSize int, tiers int, tierQueries int, workers int, search func(i int, q bins.Query, binsDB PIRBins) [][]uint64) map[string][][]uint64 {
+
+	// vector is the vector of the doc at an index of the bins doc dictionary
+	var vector func(doc uint32) []float32
+	if payload == bins.PayloadVectors {
+		rows, err := docRows.Rows(art.DocIDs)
+		bins.Must(err)
+		vector = func(doc uint32) []float32 { return bm25Vectors.Row(int(rows[doc])) }
+	}
 
-	logrus.Infof("Marco vectors: %.2f GiB", float64(MARCO_SIZE*DIM*4)/(1<<30))
-	logrus.Infof("Max row size: %d", max_row_size)
-	logrus.Infof("Padded files %d", redundancy)
+	// preprocess sets up PIR over DB, in entries of up to max_row_size docs
+	var elapsed time.Duration
+	preprocess := func(DB [][]uint32, max_row_size int) PIRBins {
+		var binsDB PIRBins
+		var took time.Duration
+		switch payload {
+		case bins.PayloadVectors:
+			binsDB, took = preprocessVectors(DB, vector, quantizer, max_row_size, workers)
+		case bins.PayloadDocIDs:
+			start := time.Now()
+			binsDB = PreprocessDocIDs(DB, max_row_size, workers)
+			took = time.Since(start)
+		default:
+			logrus.Fatalf("Unknown payload %v", payload)
+		}
+		elapsed += took
+		return binsDB
+	}
 
-	// PIR setup
-	start := time.Now()
-	bin_PIR := Preprocess(new_DB, DIM, max_row_size)
-	end := time.Now()
+	largest := 0
+	for _, bin := range art.Bins {
+		largest = max(largest, len(bin))
+	}
+	codec := bins.EntryCodec{Payload: payload, Quantizer: quantizer}
+	padded := uint64(len(art.Bins)) * uint64(bins.EntryBytes(largest, codec.SlotBytes()))
+
+	var bin_PIR PIRBins
+	if tiers == 0 {
+		layout, err := art.RowLayout(rowSize)
+		bins.Must(err)
+		layout = layout.Stripe()
+		DB, err := layout.SplitRows(art.Bins)
+		bins.Must(err)
+		logrus.Infof("Row layout: %d bins in %d rows of %d docs (%d PIR entries), every bin is fetched as %d rows "+
+			"(padding every bin would be %d rows of %d docs)",
+			layout.Bins(), layout.NumRows(), rowSize, layout.Entries(), layout.MaxRun(), layout.Bins(), largest)
+
+		bin_PIR = preprocess(DB, layout.RowSize)
+		bin_PIR.Layout = layout
+		logrus.Infof("DB: %.2f MiB vs %.2f MiB padding every bin to %d docs",
+			float64(bin_PIR.DBTotalSize)/(1<<20), float64(padded)/(1<<20), largest)
+	} else {
+		layout, err := art.TierLayout(tiers, bins.MinPIREntries)
+		bins.Must(err)
+		DBs, err := layout.Split(art.Bins)
+		bins.Must(err)
+
+		bin_PIR = PIRBins{
+			N:           layout.Bins(),
+			RowSize:     largest,
+			Tiers:       layout,
+			TierQueries: tierQueries,
+			rng:         rand.New(rand.NewSource(time.Now().UnixNano())),
+		}
+		for t, DB := range DBs {
+			tier := preprocess(DB, layout.Bounds[t])
+			bin_PIR.Dim = tier.Dim
+			bin_PIR.DBTotalSize += tier.DBTotalSize
+			bin_PIR.TierDBs = append(bin_PIR.TierDBs, tier)
+		}
+		logrus.Infof("Tiers: up to %v docs, %v bins, %.2f MiB in total vs %.2f MiB padding every bin to %d docs; "+
+			"each query sends %d sub-queries to each of the %d tiers", layout.Bounds, layout.Counts,
+			float64(bin_PIR.DBTotalSize)/(1<<20), float64(padded)/(1<<20), largest, tierQueries, len(layout.Bounds))
+	}
+	logrus.Infof("Preprocessing (%v payload) took %v", payload, elapsed)
 
 	// main.go, right after Preprocess(...) returns `bin_PIR`
 	probe := 0 // pick a few bins you *know* should be non-empty
@@ -304,7 +931,7 @@ func doPIR(DB [][]string, bm25Vectors [][]float32, d bins.DatasetMetadata) map[s
 	maintainenceTime := time.Duration(0)
 
 	// windowSize := queryEngine.PIR.SupportBatchNum / (uint64(*stepN) * uint64(*parallelN)) // For logging
-	start = time.Now()
+	start := time.Now()
 	// TODO REMOVE THIS
 	bar := progressbar.Default(int64(len(queries)), fmt.Sprintf("Answering Queries"))
 	for i := 0; i < len(queries); i++ {
@@ -312,23 +939,24 @@ func doPIR(DB [][]string, bm25Vectors [][]float32, d bins.DatasetMetadata) map[s
 
 		q := queries[i]
 
-		answers[q.ID] = BinSearch(queries[i], 1, bin_PIR)
+		answers[q.ID] = search(i, queries[i], bin_PIR)
 
-		if bin_PIR.PIR.FinishedBatchNum >= bin_PIR.PIR.SupportBatchNum {
-			// in this case we need to re-run the preprocessing
-			start := time.Now()
-			bin_PIR.PIR.Preprocessing()
-			end := time.Now()
-			maintainenceTime += end.Sub(start)
+		for _, pir := range bin_PIR.pirs() {
+			if pir.FinishedBatchNum >= pir.SupportBatchNum {
+				// in this case we need to re-run the preprocessing
+				start := time.Now()
+				pir.Preprocessing()
+				end := time.Now()
+				maintainenceTime += end.Sub(start)
+			}
 		}
 	}
 	bar.Finish()
-	end = time.Now()
+	end := time.Now()
 
 	total_query_size := 0
 
-	// TODO change to len(queries)
-	for i := 0; i < 300; i++ {
+	for i := 0; i < len(queries); i++ {
 		text := queries[i].Text
 
 		tokeniser := strictEnglishAnalyzer()
@@ -349,6 +977,35 @@ func doPIR(DB [][]string, bm25Vectors [][]float32, d bins.DatasetMetadata) map[s
 
 }
 
+// preprocessVectors sets up PIR over the vectors of the docs in each bin, encoded with quantizer. The vectors are looked
+// up as they're encoded, so the only copy of them made is the one in rawDB.
+func preprocessVectors(DB [][]uint32, vector func(doc uint32) []float32, quantizer *bins.Quantizer, max_row_size int, workers int) (PIRBins, time.Duration) {
+	redundancy := 0
+	for _, entry := range DB {
+		if len(entry) > max_row_size {
+			logrus.Warnf("Row exceeded the maximum row size!!")
+		}
+		// Padding is just the zeros after the last doc, the entry header says how many docs there are
+		redundancy += max_row_size - min(len(entry), max_row_size)
+	}
+
+	wordsPerEntry := uint64(bins.EntryCodec{Payload: bins.PayloadVectors, Quantizer: quantizer}.EntryWords(max_row_size))
+	logrus.Infof("Row layout: DIM=%d, encoding=%v, max_row_size=%d, wordsPerEntry=%d", DIM, quantizer.Encoding, max_row_size, wordsPerEntry)
+
+	b := uint64(len(DB)) * wordsPerEntry * 8
+	logrus.Infof("New DB size: %.2f MiB (%d bytes)", float64(b)/(1<<20), b)
+
+	logrus.Infof("Marco vectors: %.2f GiB", float64(MARCO_SIZE*DIM*4)/(1<<30))
+	logrus.Infof("Max row size: %d", max_row_size)
+	logrus.Infof("Padded files %d", redundancy)
+
+	// PIR setup
+	start := time.Now()
+	bin_PIR := Preprocess(DB, vector, quantizer, max_row_size, workers)
+
+	return bin_PIR, time.Since(start)
+}
+
 type PIRBins struct {
 	N       int // Items in DB
 	Dim     int // dimension of vectors
@@ -360,75 +1017,112 @@ type PIRBins struct {
 	DBTotalSize uint64 // in bytes
 	rawDB       []uint64
 	PIR         *pianopir.SimpleBatchPianoPIR
+	Layout      bins.RowLayout // which rows each bin is in
+
+	// With -tiers the bins are in TierDBs instead, PIR and Layout are unset
+	Tiers       bins.TierLayout
+	TierDBs     []PIRBins
+	TierQueries int
+	rng         *rand.Rand // padding sub-queries
+}
+
+// Bins is the number of bins, whichever way they're laid out
+func (b PIRBins) Bins() int {
+	if b.TierDBs != nil {
+		return b.Tiers.Bins()
+	}
+	return b.Layout.Bins()
 }
 
-func Preprocess(vectors_in_bins [][][]float32, Dim int, maxRowSize int) PIRBins {
-	DBEntrySize := Dim * 4 * maxRowSize // bytes per DB entry (maxRowSize vectors × Dim float32s)
-	DBSize := len(vectors_in_bins)
-	// What does words per entry even do? It was originally divided by 8?
-	// A single 'word' should be how many uint64s are required to re-make the entry
-	wordsPerEntry := DBEntrySize / 8
+// pirs is every PIR instance behind the bins
+func (b PIRBins) pirs() []*pianopir.SimpleBatchPianoPIR {
+	if b.TierDBs == nil {
+		return []*pianopir.SimpleBatchPianoPIR{b.PIR}
+	}
+	pirs := make([]*pianopir.SimpleBatchPianoPIR, len(b.TierDBs))
+	for t, tier := range b.TierDBs {
+		pirs[t] = tier.PIR
+	}
+	return pirs
+}
 
-	// FIX: allocate enough uint64s for all entries
-	rawDB := make([]uint64, DBSize*wordsPerEntry)
+// Preprocess encodes the vectors of each bin straight into its PIR entry in rawDB, DB[i] is the doc indices of bin i
+// and vector(doc) the vector of a doc. The entries are written by bins.EntryCodec, which puts each vector in a slot
+// with its doc index after a header with the row count, so the client never has to guess which slots are padding.
+func Preprocess(DB [][]uint32, vector func(doc uint32) []float32, quantizer *bins.Quantizer, maxRowSize int, workers int) PIRBins {
+	codec := bins.EntryCodec{Payload: bins.PayloadVectors, Quantizer: quantizer}
+	rawDB, wordsPerEntry := encodeEntries(codec, DB, vector, maxRowSize, workers)
 
-	bar := progressbar.Default(int64(len(vectors_in_bins)), fmt.Sprintf("Preprocessing"))
+	return newPIRBins(rawDB, len(DB), wordsPerEntry*8, quantizer.Dim, maxRowSize)
+}
 
-	for i := 0; i < len(vectors_in_bins); i++ {
-		// 1) Build byte-slices for up to maxRowSize vectors (pad zeros if fewer)
-		vectorBytesArray := make([][]byte, 0, maxRowSize)
-		for j := 0; j < len(vectors_in_bins[i]) && len(vectorBytesArray) < maxRowSize; j++ {
-			vector := vectors_in_bins[i][j]
-			vectorBytes := make([]byte, Dim*4)
-			for k := 0; k < Dim && k < len(vector); k++ {
-				binary.LittleEndian.PutUint32(vectorBytes[k*4:], math.Float32bits(vector[k]))
-			}
-			vectorBytesArray = append(vectorBytesArray, vectorBytes)
-		}
-		for len(vectorBytesArray) < maxRowSize {
-			vectorBytesArray = append(vectorBytesArray, make([]byte, Dim*4)) // zero-pad rows
-		}
+// PreprocessDocIDs is Preprocess for bins.PayloadDocIDs, each entry holds the doc indices of its bin rather than the
+// vectors
+func PreprocessDocIDs(DB [][]uint32, maxRowSize int, workers int) PIRBins {
+	codec := bins.EntryCodec{Payload: bins.PayloadDocIDs}
+	rawDB, wordsPerEntry := encodeEntries(codec, DB, nil, maxRowSize, workers)
 
-		// 2) Concatenate the row into one byte slice of size DBEntrySize
-		entryBytes := make([]byte, 0, DBEntrySize)
-		for _, vb := range vectorBytesArray {
-			entryBytes = append(entryBytes, vb...)
-		}
+	logrus.Infof("Row layout: doc IDs, max_row_size=%d, wordsPerEntry=%d", maxRowSize, wordsPerEntry)
 
-		// 3) Convert bytes → uint64s (exact 8-byte windows)
-		entry := make([]uint64, wordsPerEntry)
-		for k := 0; k < wordsPerEntry; k++ {
-			off := k * 8
-			entry[k] = binary.LittleEndian.Uint64(entryBytes[off : off+8])
-		}
+	return newPIRBins(rawDB, len(DB), wordsPerEntry*8, 0, maxRowSize)
+}
 
-		// 4) Copy into rawDB at the right offset
-		copy(rawDB[i*wordsPerEntry:], entry)
+// encodeEntries allocates rawDB and encodes bin i of DB into its i'th entry in a single pass, split over workers
+// goroutines with an encoder each. Bins over maxRowSize docs are cut short.
+func encodeEntries(codec bins.EntryCodec, DB [][]uint32, vector func(doc uint32) []float32, maxRowSize int, workers int) ([]uint64, int) {
+	wordsPerEntry := codec.EntryWords(maxRowSize)
+	rawDB := make([]uint64, len(DB)*wordsPerEntry)
 
-		bar.Add(1)
-	}
+	workers = max(1, min(workers, len(DB)))
+	chunk := (len(DB) + workers - 1) / workers
 
+	bar := progressbar.Default(int64(len(DB)), "Preprocessing")
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		start, end := w*chunk, min((w+1)*chunk, len(DB))
+		if start >= end {
+			break
+		}
+		wg.Add(1)
+		go func(start, end int) {
+			defer wg.Done()
+			enc := codec.NewEncoder()
+			for i := start; i < end; i++ {
+				bin := DB[i][:min(len(DB[i]), maxRowSize)]
+				entry := rawDB[i*wordsPerEntry : (i+1)*wordsPerEntry]
+				bins.Must(enc.Encode(entry, bin, func(j int) []float32 { return vector(bin[j]) }))
+				bar.Add(1)
+			}
+		}(start, end)
+	}
+	wg.Wait()
 	bar.Finish()
+
+	return rawDB, wordsPerEntry
+}
+
+// newPIRBins sets up PIR over an already encoded rawDB of DBSize entries of DBEntrySize bytes
+func newPIRBins(rawDB []uint64, DBSize int, DBEntrySize int, Dim int, maxRowSize int) PIRBins {
 	// Set up the PIR
 	setSize := (uint64(len(rawDB)) + 2047) / 2048 // ceil division by 2048
 	setSize = (setSize + 3) / 4 * 4               // round up to multiple of 4
 	logrus.Infof("setSize: %d", setSize)
 
 	//pir := pianopir.NewSimpleBatchPianoPIR(uint64(len(vectors_in_bins)), uint64(DBEntrySize), 32, rawDB, 8)
-	pir := pianopir.NewSimpleBatchPianoPIR(uint64(len(vectors_in_bins)), uint64(DBEntrySize), 32, rawDB, 8)
+	pir := pianopir.NewSimpleBatchPianoPIR(uint64(DBSize), uint64(DBEntrySize), bins.PIRBatchSize, rawDB, pirFailureProbLog2)
 
 	logrus.Info("PIR Ready for preprocessing")
 
 	pir.Preprocessing()
 
 	ret := PIRBins{
-		N:       len(vectors_in_bins),
-		Dim:     int(Dim),
-		RowSize: int(maxRowSize),
+		N:       DBSize,
+		Dim:     Dim,
+		RowSize: maxRowSize,
 		rawDB:   rawDB,
 
 		PIR:         pir,
-		DBTotalSize: uint64(len(vectors_in_bins) * DBEntrySize),
+		DBTotalSize: uint64(DBSize * DBEntrySize),
 		DBEntrySize: uint64(DBEntrySize),
 	}
 
@@ -455,53 +1149,106 @@ func strictEnglishAnalyzer() *analysis.Analyzer {
 	}
 }
 
-func hashTokenChoice(tokens string, i uint) uint64 {
-	// Join all strings into a single byte sequence
-	// joined := strings.Join(tokens, "|")
-	data := []byte(tokens)
-
-	// Append integer i in big-endian form
-	var buf [4]byte
-	binary.BigEndian.PutUint32(buf[:], uint32(i))
-	data = append(data, buf[:]...)
-
-	// Hash with SHA-256
-	sum := sha256.Sum256(data)
-
-	// Take the first 8 bytes as uint64
-	return binary.BigEndian.Uint64(sum[0:8])
-}
-
-func make_indices(query_text string, choices uint, modulus uint) []uint64 {
+// query_terms is the query's tokens in the order bins.PlanProbes turns them into bins
+func query_terms(query_text string) []string {
 	tokeniser := strictEnglishAnalyzer()
 	tokens := tokeniser.Analyze([]byte(query_text))
 
-	indices := make([]uint64, len(tokens))
+	terms := make([]string, len(tokens))
 	for i, t := range tokens {
-		indices[i] = hashTokenChoice(fmt.Sprintf("%s", t.Term), choices) % uint64(modulus)
+		terms[i] = string(t.Term)
 	}
+	return terms
+}
 
-	return indices
+// fetchBins privately fetches each of the bins in one batch, and returns each bin's rows back to back. Every bin is
+// fetched as the same number of rows (see bins.RowLayout.Fetch), so the server can't tell how big the bins are.
+func fetchBins(binsDB PIRBins, indices []uint64) [][]uint64 {
+	if binsDB.TierDBs != nil {
+		return fetchTiers(binsDB, indices)
+	}
+
+	answers, dropped, err := binsDB.Layout.FetchBins(binsDB.PIR.Query, indices)
+	bins.Must(err)
+	if dropped > 0 {
+		logrus.Debugf("Piano dropped %d of the rows of %d bins", dropped, len(indices))
+	}
+	return answers
 }
 
-func BinSearch(queries bins.Query, d int, binsDB PIRBins) [][]uint64 {
+// fetchTiers is fetchBins for -tiers: every tier gets the same number of sub-queries, padded with random ones, so
+// the server can't tell which tiers the bins are in. Bins that don't fit in their tier's sub-queries come back empty,
+// like the ones Piano drops.
+func fetchTiers(binsDB PIRBins, indices []uint64) [][]uint64 {
+	batch := binsDB.Tiers.Batch(indices, binsDB.TierQueries, binsDB.rng)
+	if batch.Dropped > 0 {
+		logrus.Debugf("Dropped %d of %d bins past -tier-queries=%d", batch.Dropped, len(indices), binsDB.TierQueries)
+	}
 
-	// convert the query text to bin indexs
+	answers := make([][]uint64, len(indices))
+	dropped := 0
+	for t, tier := range binsDB.TierDBs {
+		responses, err := tier.PIR.Query(batch.Indices[t])
+		bins.Must(err)
+		for j, slot := range batch.Slots[t] {
+			if slot < 0 {
+				continue
+			}
+			// every entry EntryCodec writes starts with a non-zero version
+			if responses[j][0] == 0 {
+				dropped++
+			}
+			answers[slot] = responses[j]
+		}
+	}
+	if dropped > 0 {
+		logrus.Debugf("Piano dropped %d of the %d bins", dropped, len(indices))
+	}
+	for i := range answers {
+		if answers[i] == nil {
+			answers[i] = make([]uint64, bins.EntryHeaderBytes/8)
+		}
+	}
+	return answers
+}
 
-	indices := make_indices(queries.Text, uint(d), uint(binsDB.N))
-	prev_size := len(indices)
+// BinSearch privately fetches the bins of every token of the query under each of choices, each distinct bin once
+func BinSearch(q bins.Query, choices []uint, binsDB PIRBins) [][]uint64 {
+	plan := bins.PlanProbes(query_terms(q.Text), choices, uint(binsDB.Bins()))
 
-	//for len(indices) != 32 { // Pad indicea to batch size
-	//	indices = append(indices, 1)
-	//}
-	responses, err := binsDB.PIR.Query(indices)
-	bins.Must(err)
+	return fetchBins(binsDB, plan.Indices)
+}
+
+// parseChoices parses -choices, nil when it's empty
+func parseChoices(s string) []uint {
+	if s == "" {
+		return nil
+	}
+	var choices []uint
+	for _, f := range strings.Split(s, ",") {
+		c, err := strconv.ParseUint(strings.TrimSpace(f), 10, 32)
+		if err != nil {
+			logrus.Fatalf("Bad -choices %q: %v", s, err)
+		}
+		choices = append(choices, uint(c))
+	}
+	return choices
+}
 
-	responses = responses[:prev_size]
+// ClusterSearch is BinSearch for -binning=kmeans: the client privately fetches the bins of the nprobe centroids nearest
+// its query embedding
+func ClusterSearch(query []float32, centroids [][]float32, nprobe int, binsDB PIRBins) [][]uint64 {
+	return fetchBins(binsDB, bins.NearestClusters(centroids, query, nprobe))
+}
 
-	//for len(responses) != prev_size {
-	//	responses = append(responses[:1], responses[2:]...)
-	//}
+// HybridSearch queries a hybrid DB (see bins.NewHybridArtifact): the query's token bins under each of choices and the
+// bins of the nprobe clusters nearest its embedding go into the same batch, token bins first
+func HybridSearch(q bins.Query, choices []uint, embedding []float32, centroids [][]float32, nprobe int, layout bins.HybridLayout, binsDB PIRBins) [][]uint64 {
+	plan := bins.PlanProbes(query_terms(q.Text), choices, uint(layout.LexicalBins))
+	indices := plan.Indices
+	for _, c := range bins.NearestClusters(centroids, embedding, nprobe) {
+		indices = append(indices, layout.ClusterIndex(c))
+	}
 
-	return responses
+	return fetchBins(binsDB, indices)
 }
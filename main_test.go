@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/dkblackley/bm25-bins-go/bins"
+)
+
+// Skewed bins, like real ones: the tier split used to put the few big ones in a PIR DB of their own, which Piano
+// panics on when it has fewer entries than partitions
+func TestDoPIR(t *testing.T) {
+	defer func(p uint64) { pirFailureProbLog2 = p }(pirFailureProbLog2)
+	pirFailureProbLog2 = 40
+
+	rng := rand.New(rand.NewSource(1))
+	docIDs := make([]string, 500)
+	for i := range docIDs {
+		docIDs[i] = fmt.Sprint(i)
+	}
+	DB := make([][]string, 300)
+	for b := range DB {
+		size := rng.Intn(4)
+		if b%100 == 7 {
+			size = 60
+		}
+		for _, i := range rng.Perm(len(docIDs))[:size] {
+			DB[b] = append(DB[b], docIDs[i])
+		}
+	}
+	art, err := bins.NewBinsArtifact(DB, bins.BuildStats{TermsPerBin: make([]uint32, len(DB))}, docIDs, "test", "", bins.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queries := filepath.Join(t.TempDir(), "queries.jsonl")
+	if err := os.WriteFile(queries, []byte("{\"_id\": \"q0\", \"text\": \"a\"}\n{\"_id\": \"q1\", \"text\": \"b\"}\n{\"_id\": \"q2\", \"text\": \"c\"}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	wanted := [][]uint64{{7, 3}, {107, 207, 0}, {150}}
+	search := func(i int, q bins.Query, binsDB PIRBins) [][]uint64 {
+		return fetchBins(binsDB, wanted[i])
+	}
+
+	// and the same through the row layout, where the big bins span many rows
+	for _, tiers := range []int{4, 0} {
+		rowSize := 2
+		answers := doPIR(art, nil, nil, nil, bins.DatasetMetadata{Queries: queries}, bins.PayloadDocIDs, rowSize, tiers, 32, 2, search)
+
+		codec := bins.EntryCodec{Payload: bins.PayloadDocIDs}
+		if tiers == 0 {
+			codec.RowWords = codec.EntryWords(rowSize)
+		}
+		for i, bs := range wanted {
+			entries := answers[fmt.Sprintf("q%d", i)]
+			if len(entries) != len(bs) {
+				t.Fatalf("tiers=%d: q%d got %d bins; want %d", tiers, i, len(entries), len(bs))
+			}
+			for j, b := range bs {
+				docs, _, err := codec.Decode(entries[j])
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(docs) != len(art.Bins[b]) || (len(docs) > 0 && !reflect.DeepEqual(docs, art.Bins[b])) {
+					t.Errorf("tiers=%d: q%d bin %d came back as %v; want %v", tiers, i, b, docs, art.Bins[b])
+				}
+			}
+		}
+	}
+}
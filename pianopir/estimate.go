@@ -0,0 +1,66 @@
+package pianopir
+
+// BatchPIRCosts are the numbers SimpleBatchPianoPIR.PrintInfo reports, worked out from the shape of the DB alone so
+// they're available before a DB (or rawDB) exists
+type BatchPIRCosts struct {
+	DBSize         uint64
+	DBEntryByteNum uint64
+	BatchSize      uint64
+	PartitionNum   uint64
+	PartitionSize  uint64
+
+	DBBytes                   float64 // DBSize * DBEntryByteNum
+	MaxQueryNum               uint64  // batches supported by one preprocessing
+	LocalStorage              float64 // bytes of client hints
+	CommCostPerBatchOnline    uint64  // bytes
+	AmortizedPrepCommPerBatch float64 // bytes of preprocessing download amortized over MaxQueryNum batches
+}
+
+// EstimateSimpleBatchPianoPIR works out the costs NewSimpleBatchPianoPIR(DBSize, DBEntryByteNum, BatchSize, _,
+// FailureProbLog2) would have, using the same parameter choices
+func EstimateSimpleBatchPianoPIR(DBSize uint64, DBEntryByteNum uint64, BatchSize uint64, FailureProbLog2 uint64) BatchPIRCosts {
+	PartitionNum := BatchSize / RealQueryPerPartition
+	PartitionSize := (DBSize + PartitionNum - 1) / PartitionNum
+
+	costs := BatchPIRCosts{
+		DBSize:         DBSize,
+		DBEntryByteNum: DBEntryByteNum,
+		BatchSize:      BatchSize,
+		PartitionNum:   PartitionNum,
+		PartitionSize:  PartitionSize,
+		DBBytes:        float64(DBSize) * float64(DBEntryByteNum),
+	}
+
+	online := float64(0)
+	for i := uint64(0); i < PartitionNum; i++ {
+		start := i * PartitionSize
+		end := min((i+1)*PartitionSize, DBSize)
+
+		config := newPianoPIRConfig(end-start, DBEntryByteNum, FailureProbLog2)
+		maxQueryNum, primaryHintNum, maxQueryPerChunk := clientParams(config)
+		if i == 0 {
+			costs.MaxQueryNum = maxQueryNum / QueryPerPartition
+		}
+		costs.LocalStorage += localStorageSize(config, primaryHintNum, maxQueryPerChunk)
+		// same as PianoPIR.CommCostPerQuery
+		online += float64(config.SetSize*4+config.DBEntrySize*8) * float64(QueryPerPartition)
+	}
+	costs.CommCostPerBatchOnline = uint64(online)
+	if costs.MaxQueryNum > 0 {
+		costs.AmortizedPrepCommPerBatch = costs.DBBytes / float64(costs.MaxQueryNum)
+	}
+
+	return costs
+}
+
+// MinPartitionSize is the fewest entries a partition of a SimpleBatchPianoPIR can have. A smaller one gets a client
+// that supports no queries (or too few to finish a batch), so everything asked of it comes back as zeros.
+func MinPartitionSize() uint64 {
+	for size := uint64(1); ; size++ {
+		maxQueryNum, _, maxQueryPerChunk := clientParams(newPianoPIRConfig(size, 32, 0))
+		// SimpleBatchPianoPIR.Query redoes the preprocessing at MaxQueryNum-2
+		if maxQueryNum > 2 && maxQueryNum/QueryPerPartition > 0 && maxQueryPerChunk > 0 {
+			return size
+		}
+	}
+}
@@ -126,6 +126,16 @@ func primaryNumParam(Q float64, ChunkSize float64, target uint64) uint64 {
 	return uint64(k) * uint64(ChunkSize)
 }
 
+// clientParams returns the max query num, the primary hint num and the max query per chunk of a client for config
+func clientParams(config *PianoPIRConfig) (uint64, uint64, uint64) {
+	maxQueryNum := uint64(math.Sqrt(float64(config.DBSize)) * math.Log(float64(config.DBSize)))
+	primaryHintNum := primaryNumParam(float64(maxQueryNum), float64(config.ChunkSize), config.FailureProbLog2+1) // fail prob 2^(-41)
+	primaryHintNum = (primaryHintNum + config.ThreadNum - 1) / config.ThreadNum * config.ThreadNum
+	maxQueryPerChunk := 3 * uint64(float64(maxQueryNum)/float64(config.SetSize))
+	maxQueryPerChunk = (maxQueryPerChunk + config.ThreadNum - 1) / config.ThreadNum * config.ThreadNum
+	return maxQueryNum, primaryHintNum, maxQueryPerChunk
+}
+
 // NewPianoPIRClient is an initialization function for the client
 func NewPianoPIRClient(config *PianoPIRConfig) *PianoPIRClient {
 
@@ -135,11 +145,7 @@ func NewPianoPIRClient(config *PianoPIRConfig) *PianoPIRClient {
 	longKey := GetLongKey((*PrfKey128)(&masterKey))
 	//seed := int64(1678852332934430000)
 
-	maxQueryNum := uint64(math.Sqrt(float64(config.DBSize)) * math.Log(float64(config.DBSize)))
-	primaryHintNum := primaryNumParam(float64(maxQueryNum), float64(config.ChunkSize), config.FailureProbLog2+1) // fail prob 2^(-41)
-	primaryHintNum = (primaryHintNum + config.ThreadNum - 1) / config.ThreadNum * config.ThreadNum
-	maxQueryPerChunk := 3 * uint64(float64(maxQueryNum)/float64(config.SetSize))
-	maxQueryPerChunk = (maxQueryPerChunk + config.ThreadNum - 1) / config.ThreadNum * config.ThreadNum
+	maxQueryNum, primaryHintNum, maxQueryPerChunk := clientParams(config)
 
 	//fmt.Printf("maxQueryNum = %v\n", maxQueryNum)
 	//fmt.Printf("primaryHintNum = %v\n", primaryHintNum)
@@ -176,15 +182,19 @@ func NewPianoPIRClient(config *PianoPIRConfig) *PianoPIRClient {
 
 // return the local storage in bytes
 func (c *PianoPIRClient) LocalStorageSize() float64 {
+	return localStorageSize(c.config, c.primaryHintNum, c.maxQueryPerChunk)
+}
+
+func localStorageSize(config *PianoPIRConfig, primaryHintNum uint64, maxQueryPerChunk uint64) float64 {
 	localStorageSize := float64(0)
-	localStorageSize = localStorageSize + float64(c.primaryHintNum)*8                                // the primary hint short tag
-	localStorageSize = localStorageSize + float64(c.primaryHintNum)*float64(c.config.DBEntryByteNum) // the primary parity
-	localStorageSize = localStorageSize + float64(c.primaryHintNum)*8                                // the primary program point
-	totalBackupHintNum := float64(c.config.SetSize) * float64(c.maxQueryPerChunk)
-	localStorageSize = localStorageSize + float64(totalBackupHintNum)*8                                // the replacement indices
-	localStorageSize = localStorageSize + float64(totalBackupHintNum)*float64(c.config.DBEntryByteNum) // the replacement values
-	localStorageSize = localStorageSize + float64(totalBackupHintNum)*8                                // the backup short tag
-	localStorageSize = localStorageSize + float64(totalBackupHintNum)*float64(c.config.DBEntryByteNum) // the backup parities
+	localStorageSize = localStorageSize + float64(primaryHintNum)*8                              // the primary hint short tag
+	localStorageSize = localStorageSize + float64(primaryHintNum)*float64(config.DBEntryByteNum) // the primary parity
+	localStorageSize = localStorageSize + float64(primaryHintNum)*8                              // the primary program point
+	totalBackupHintNum := float64(config.SetSize) * float64(maxQueryPerChunk)
+	localStorageSize = localStorageSize + float64(totalBackupHintNum)*8                              // the replacement indices
+	localStorageSize = localStorageSize + float64(totalBackupHintNum)*float64(config.DBEntryByteNum) // the replacement values
+	localStorageSize = localStorageSize + float64(totalBackupHintNum)*8                              // the backup short tag
+	localStorageSize = localStorageSize + float64(totalBackupHintNum)*float64(config.DBEntryByteNum) // the backup parities
 
 	return localStorageSize
 }
@@ -476,14 +486,7 @@ type PianoPIR struct {
 	server *PianoPIRServer
 }
 
-func NewPianoPIR(DBSize uint64, DBEntryByteNum uint64, rawDB []uint64, FailureProbLog2 uint64) *PianoPIR {
-	DBEntrySize := DBEntryByteNum / 8
-
-	// assert that the rawDB is of the correct size
-	if uint64(len(rawDB)) != DBSize*DBEntrySize {
-		log.Fatalf("Piano PIR len(rawDB) = %v; want %v", len(rawDB), DBSize*DBEntrySize)
-	}
-
+func newPianoPIRConfig(DBSize uint64, DBEntryByteNum uint64, FailureProbLog2 uint64) *PianoPIRConfig {
 	targetChunkSize := uint64(2 * math.Sqrt(float64(DBSize)))
 	ChunkSize := uint64(1)
 	for ChunkSize < targetChunkSize {
@@ -493,15 +496,26 @@ func NewPianoPIR(DBSize uint64, DBEntryByteNum uint64, rawDB []uint64, FailurePr
 	// round up to the next mulitple of 4
 	SetSize = (SetSize + 3) / 4 * 4
 
-	config := &PianoPIRConfig{
+	return &PianoPIRConfig{
 		DBEntryByteNum:  DBEntryByteNum,
-		DBEntrySize:     DBEntrySize,
+		DBEntrySize:     DBEntryByteNum / 8,
 		DBSize:          DBSize,
 		ChunkSize:       ChunkSize,
 		SetSize:         SetSize,
 		ThreadNum:       8,
 		FailureProbLog2: FailureProbLog2,
 	}
+}
+
+func NewPianoPIR(DBSize uint64, DBEntryByteNum uint64, rawDB []uint64, FailureProbLog2 uint64) *PianoPIR {
+	DBEntrySize := DBEntryByteNum / 8
+
+	// assert that the rawDB is of the correct size
+	if uint64(len(rawDB)) != DBSize*DBEntrySize {
+		log.Fatalf("Piano PIR len(rawDB) = %v; want %v", len(rawDB), DBSize*DBEntrySize)
+	}
+
+	config := newPianoPIRConfig(DBSize, DBEntryByteNum, FailureProbLog2)
 
 	client := NewPianoPIRClient(config)
 	server := NewPianoPIRServer(config, rawDB)
@@ -375,3 +375,55 @@ func TestAESPerf(t *testing.T) {
 	t.Logf("XorSlices time = %v\n", end.Sub(start))
 	t.Logf("average time = %v ns", end.Sub(start).Nanoseconds()/int64(n))
 }
+
+func TestEstimateSimpleBatchPianoPIR(t *testing.T) {
+	DBSize := uint64(5000)
+	DBEntrySize := uint64(8)
+	BatchSize := uint64(32)
+
+	rawDB := make([]uint64, DBEntrySize*DBSize)
+	PIR := NewSimpleBatchPianoPIR(DBSize, DBEntrySize*8, BatchSize, rawDB, 20)
+	costs := EstimateSimpleBatchPianoPIR(DBSize, DBEntrySize*8, BatchSize, 20)
+
+	if costs.LocalStorage != PIR.LocalStorageSize() {
+		t.Errorf("LocalStorage = %v; want %v", costs.LocalStorage, PIR.LocalStorageSize())
+	}
+	if costs.CommCostPerBatchOnline != PIR.CommCostPerBatchOnline() {
+		t.Errorf("CommCostPerBatchOnline = %v; want %v", costs.CommCostPerBatchOnline, PIR.CommCostPerBatchOnline())
+	}
+	if maxQuery := PIR.subPIR[0].client.MaxQueryNum / QueryPerPartition; costs.MaxQueryNum != maxQuery {
+		t.Errorf("MaxQueryNum = %v; want %v", costs.MaxQueryNum, maxQuery)
+	}
+}
+
+func TestMinPartitionSize(t *testing.T) {
+	size := MinPartitionSize()
+	BatchSize := uint64(32)
+	PartitionNum := BatchSize / RealQueryPerPartition
+	DBSize := PartitionNum * size
+	DBEntrySize := uint64(4)
+
+	rawDB := make([]uint64, DBEntrySize*DBSize)
+	for i := range rawDB {
+		rawDB[i] = uint64(i)/DBEntrySize + 1
+	}
+	PIR := NewSimpleBatchPianoPIR(DBSize, DBEntrySize*8, BatchSize, rawDB, 40)
+	PIR.Preprocessing()
+
+	// enough batches to run through the preprocessing a few times
+	for round := 0; round < 20; round++ {
+		batch := make([]uint64, PartitionNum)
+		for i := range batch {
+			batch[i] = uint64(i)*size + rand.Uint64()%size
+		}
+		responses, err := PIR.Query(batch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, idx := range batch {
+			if responses[i][0] != idx+1 {
+				t.Fatalf("round %d: entry %d came back as %d", round, idx, responses[i][0])
+			}
+		}
+	}
+}